@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/tidepool-org/go-common/events"
+	"github.com/tidepool-org/mailer/consumer"
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+const sendEmailTimeout = time.Second * 30
+
+// EventSource is the event source tag of the emails sent through the api
+const EventSource = "api"
+
+// maxRequestSize matches the maximum size of a raw message accepted by SES
+const maxRequestSize = 40 << 20
+
+type EmailSender interface {
+	SendEmailTemplate(ctx context.Context, payload consumer.SendEmailTemplatePayload) (string, error)
+}
+
+// SendEmailRequest has the same shape as the send email template event
+type SendEmailRequest struct {
+	Recipient   string                `json:"recipient" validate:"required,email"`
+	To          []string              `json:"to" validate:"dive,email"`
+	Cc          []string              `json:"cc" validate:"dive,email"`
+	Bcc         []string              `json:"bcc" validate:"dive,email"`
+	ReplyTo     string                `json:"reply_to" validate:"omitempty,email"`
+	Headers     map[string]string     `json:"headers"`
+	Template    string                `json:"template" validate:"required"`
+	Variables   map[string]string     `json:"variables"`
+	Attachments []SendEmailAttachment `json:"attachments" validate:"dive"`
+}
+
+// SendEmailAttachment is either embedded as base64 encoded data or referenced by an https or s3 url
+type SendEmailAttachment struct {
+	ContentType string `json:"content_type" validate:"required"`
+	Data        string `json:"data" validate:"required_without=Reference,excluded_with=Reference,omitempty,base64"`
+	Filename    string `json:"filename" validate:"required"`
+	Reference   string `json:"reference" validate:"omitempty,url"`
+}
+
+type SendEmailResponse struct {
+	MessageID string `json:"message_id"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func SendEmailHandler(logger *zap.SugaredLogger, validate *validator.Validate, sender EmailSender) (http.HandlerFunc, error) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request := SendEmailRequest{}
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+		if err := decoder.Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err := validate.Struct(request); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), sendEmailTimeout)
+		defer cancel()
+		id, err := sender.SendEmailTemplate(ctx, request.toPayload())
+		if errors.Is(err, consumer.ErrRecipientSuppressed) {
+			logger.Infow("Not sending email to suppressed recipient", "template", request.Template)
+			writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+			return
+		} else if err != nil {
+			status := http.StatusBadGateway
+			if mailer.IsPermanent(err) {
+				status = http.StatusUnprocessableEntity
+			} else if errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusGatewayTimeout
+			}
+			logger.Warnw("Unable to send email", "template", request.Template, "status", status, "error", err)
+			writeJSON(w, status, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, SendEmailResponse{MessageID: id})
+	}, nil
+}
+
+func (s SendEmailRequest) toPayload() consumer.SendEmailTemplatePayload {
+	payload := consumer.SendEmailTemplatePayload{
+		SendEmailTemplateEvent: events.SendEmailTemplateEvent{
+			Recipient: s.Recipient,
+			Template:  s.Template,
+			Variables: s.Variables,
+		},
+		To:          s.To,
+		Cc:          s.Cc,
+		Bcc:         s.Bcc,
+		ReplyTo:     s.ReplyTo,
+		Headers:     s.Headers,
+		Source:      EventSource,
+		Attachments: make([]consumer.EmailAttachment, len(s.Attachments)),
+	}
+	for i, attachment := range s.Attachments {
+		payload.Attachments[i] = consumer.EmailAttachment{
+			EmailAttachment: events.EmailAttachment{
+				ContentType: attachment.ContentType,
+				Data:        attachment.Data,
+				Filename:    attachment.Filename,
+			},
+			Reference: attachment.Reference,
+		}
+	}
+	return payload
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,63 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/tidepool-org/mailer/api"
+	"github.com/tidepool-org/mailer/consumer"
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+type fakeEmailSender struct {
+	id  string
+	err error
+}
+
+func (f *fakeEmailSender) SendEmailTemplate(ctx context.Context, payload consumer.SendEmailTemplatePayload) (string, error) {
+	return f.id, f.err
+}
+
+func Test_SendEmailHandler(t *testing.T) {
+	tests := map[string]struct {
+		sender *fakeEmailSender
+		status int
+	}{
+		"sent":                 {sender: &fakeEmailSender{id: "message-id"}, status: http.StatusOK},
+		"suppressed recipient": {sender: &fakeEmailSender{err: consumer.ErrRecipientSuppressed}, status: http.StatusConflict},
+		"permanent failure":    {sender: &fakeEmailSender{err: mailer.NewPermanentError(consumer.ErrUnknownTemplate)}, status: http.StatusUnprocessableEntity},
+		"transient failure":    {sender: &fakeEmailSender{err: &mailer.BackendError{Backend: "ses", Code: "TooManyRequestsException", Err: errors.New("throttled")}}, status: http.StatusBadGateway},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			handler, err := api.SendEmailHandler(zap.NewNop().Sugar(), validator.New(), test.sender)
+			if err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			}
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/v1/emails", strings.NewReader(`{"recipient": "patient@example.com", "template": "greeting"}`)))
+			if res.Code != test.status {
+				t.Fatalf(`Status is %v, but should be %v`, res.Code, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+
+			response := api.SendEmailResponse{}
+			if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			}
+			if response.MessageID != test.sender.id {
+				t.Fatalf(`Message id is "%s", but should be "%s"`, response.MessageID, test.sender.id)
+			}
+		})
+	}
+}
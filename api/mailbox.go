@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+// MailboxHandler is the inspection API of the memory backend, which is meant for end-to-end tests:
+//
+//	GET /v1/mailbox lists the captured emails, the ?recipient= query parameter filters them by recipient
+//	DELETE /v1/mailbox discards all captured emails
+//	GET /v1/mailbox/{id} returns the captured email
+//	GET /v1/mailbox/{id}/raw returns the raw MIME message of the captured email
+func MailboxHandler(logger *zap.SugaredLogger, mailbox *mailer.MemoryMailer) (http.Handler, error) {
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/mailbox", func(w http.ResponseWriter, r *http.Request) {
+		if recipient := r.URL.Query().Get("recipient"); recipient != "" {
+			writeJSON(w, http.StatusOK, mailbox.ListByRecipient(recipient))
+			return
+		}
+		writeJSON(w, http.StatusOK, mailbox.List())
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/v1/mailbox", func(w http.ResponseWriter, r *http.Request) {
+		mailbox.Clear()
+		logger.Infow("Cleared mailbox")
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodDelete)
+
+	router.HandleFunc("/v1/mailbox/{id}", func(w http.ResponseWriter, r *http.Request) {
+		captured := mailbox.Get(mux.Vars(r)["id"])
+		if captured == nil {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "email not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, captured)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/v1/mailbox/{id}/raw", func(w http.ResponseWriter, r *http.Request) {
+		captured := mailbox.Get(mux.Vars(r)["id"])
+		if captured == nil {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "email not found"})
+			return
+		}
+		w.Header().Set("content-type", "message/rfc822")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(captured.Raw)
+	}).Methods(http.MethodGet)
+
+	return router, nil
+}
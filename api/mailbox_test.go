@@ -0,0 +1,65 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tidepool-org/mailer/api"
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+func Test_MailboxHandler(t *testing.T) {
+	mailbox := mailer.NewMemoryMailer(&mailer.MemoryMailerParams{
+		Cfg:    &mailer.MemoryMailerConfig{SenderName: "Tidepool", SenderAddress: "noreply@tidepool.org", Capacity: 10},
+		Logger: zap.NewNop().Sugar(),
+	})
+	handler, err := api.MailboxHandler(zap.NewNop().Sugar(), mailbox)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	serve := func(method string, target string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(method, target, nil))
+		return res
+	}
+
+	id, err := mailbox.Send(context.Background(), &mailer.Email{
+		Recipients: []string{"clinician@example.com"},
+		Subject:    "Invitation",
+		Body:       `<a href="https://app.tidepool.org/invite/123">Accept</a>`,
+	})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if _, err := mailbox.Send(context.Background(), &mailer.Email{Recipients: []string{"patient@example.com"}, Subject: "Reminder", Body: "<p>Reminder</p>"}); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	var emails []mailer.CapturedEmail
+	if err := json.NewDecoder(serve(http.MethodGet, "/v1/mailbox?recipient=Clinician@example.com").Body).Decode(&emails); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(emails) != 1 || emails[0].ID != id || !strings.Contains(emails[0].Email.Body, "https://app.tidepool.org/invite/123") {
+		t.Fatalf(`Emails are %v, but should contain the invitation`, emails)
+	}
+
+	res := serve(http.MethodGet, "/v1/mailbox/"+id+"/raw")
+	if res.Code != http.StatusOK || res.Header().Get("content-type") != "message/rfc822" || !strings.Contains(res.Body.String(), "Subject: Invitation") {
+		t.Fatalf(`Expected the raw invitation, got %v %s`, res.Code, res.Body)
+	}
+
+	if res := serve(http.MethodDelete, "/v1/mailbox"); res.Code != http.StatusNoContent {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusNoContent)
+	}
+	if res := serve(http.MethodGet, "/v1/mailbox/"+id); res.Code != http.StatusNotFound {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusNotFound)
+	}
+	if res := serve(http.MethodGet, "/v1/mailbox"); strings.TrimSpace(res.Body.String()) != "[]" {
+		t.Fatalf(`Mailbox is %s, but should be empty`, res.Body)
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/tidepool-org/mailer/notifications"
+	"go.uber.org/zap"
+)
+
+const maxNotificationSize = 256 << 10
+
+// SESNotificationsHandler is the SNS HTTP subscription endpoint for SES bounce, complaint and delivery
+// notifications. Server errors are returned to SNS, so the message is redelivered. The handler is nil if the
+// notifications are disabled.
+func SESNotificationsHandler(logger *zap.SugaredLogger, processor *notifications.Processor) (http.HandlerFunc, error) {
+	if processor == nil {
+		return nil, nil
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxNotificationSize))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		if err := processor.Process(r.Context(), body); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, notifications.ErrInvalidSignature) || errors.Is(err, notifications.ErrUntrustedURL) || errors.Is(err, notifications.ErrUnknownTopic) || errors.Is(err, notifications.ErrStaleMessage) {
+				status = http.StatusForbidden
+			} else if errors.Is(err, notifications.ErrInvalidNotification) {
+				status = http.StatusBadRequest
+			}
+			logger.Warnw("Unable to process sns message", "status", status, "error", err)
+			writeJSON(w, status, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}, nil
+}
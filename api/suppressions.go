@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/tidepool-org/mailer/consumer"
+	"go.uber.org/zap"
+)
+
+const maxSuppressionRequestSize = 1 << 20
+
+type AddSuppressionRequest struct {
+	Email       string                     `json:"email" validate:"required,email"`
+	Reason      consumer.SuppressionReason `json:"reason" validate:"omitempty,oneof=bounce complaint manual unsubscribed"`
+	Description string                     `json:"description"`
+}
+
+// SuppressionsHandler is the admin API of the suppression list:
+//
+//	GET /v1/suppressions lists all suppressions
+//	POST /v1/suppressions adds a suppression, the reason defaults to manual
+//	GET /v1/suppressions/{email} returns the suppression of the email address
+//	DELETE /v1/suppressions/{email} removes the suppression of the email address
+//
+// The API is not authenticated, so it must only be served by the internal server.
+func SuppressionsHandler(logger *zap.SugaredLogger, validate *validator.Validate, suppressions consumer.SuppressionStore) (http.Handler, error) {
+	router := mux.NewRouter()
+	router.HandleFunc("/v1/suppressions", func(w http.ResponseWriter, r *http.Request) {
+		result, err := suppressions.List(r.Context())
+		if err != nil {
+			logger.Errorw("Unable to list suppressions", "error", err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/v1/suppressions", func(w http.ResponseWriter, r *http.Request) {
+		request := AddSuppressionRequest{}
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSuppressionRequestSize))
+		if err := decoder.Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err := validate.Struct(request); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if request.Reason == "" {
+			request.Reason = consumer.SuppressionReasonManual
+		}
+
+		err := suppressions.Add(r.Context(), consumer.Suppression{
+			Email:       request.Email,
+			Reason:      request.Reason,
+			Description: request.Description,
+		})
+		if err != nil {
+			logger.Errorw("Unable to add suppression", "error", err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return
+		}
+		getSuppression(logger, suppressions, w, r, request.Email, http.StatusCreated)
+	}).Methods(http.MethodPost)
+
+	router.HandleFunc("/v1/suppressions/{email}", func(w http.ResponseWriter, r *http.Request) {
+		getSuppression(logger, suppressions, w, r, mux.Vars(r)["email"], http.StatusOK)
+	}).Methods(http.MethodGet)
+
+	router.HandleFunc("/v1/suppressions/{email}", func(w http.ResponseWriter, r *http.Request) {
+		if err := suppressions.Remove(r.Context(), mux.Vars(r)["email"]); err != nil {
+			logger.Errorw("Unable to remove suppression", "error", err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodDelete)
+
+	return router, nil
+}
+
+func getSuppression(logger *zap.SugaredLogger, suppressions consumer.SuppressionStore, w http.ResponseWriter, r *http.Request, email string, status int) {
+	suppression, err := suppressions.Get(r.Context(), email)
+	if err != nil {
+		logger.Errorw("Unable to get suppression", "error", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if suppression == nil {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "email is not suppressed"})
+		return
+	}
+	writeJSON(w, status, suppression)
+}
@@ -0,0 +1,50 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/tidepool-org/mailer/api"
+	"github.com/tidepool-org/mailer/consumer"
+	"go.uber.org/zap"
+)
+
+func Test_SuppressionsHandler(t *testing.T) {
+	handler, err := api.SuppressionsHandler(zap.NewNop().Sugar(), validator.New(), consumer.NewMemorySuppressionStore())
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	serve := func(method string, target string, body string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return res
+	}
+
+	res := serve(http.MethodPost, "/v1/suppressions", `{"email": "patient@example.com", "description": "requested by support"}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusCreated)
+	}
+	if res := serve(http.MethodPost, "/v1/suppressions", `{"email": "patient@example.com", "reason": "unknown"}`); res.Code != http.StatusBadRequest {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusBadRequest)
+	}
+
+	res = serve(http.MethodGet, "/v1/suppressions", "")
+	var suppressions []consumer.Suppression
+	if err := json.NewDecoder(res.Body).Decode(&suppressions); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(suppressions) != 1 || suppressions[0].Reason != consumer.SuppressionReasonManual || suppressions[0].Description != "requested by support" {
+		t.Fatalf(`Suppressions are %v, but should contain the manual suppression`, suppressions)
+	}
+
+	if res := serve(http.MethodDelete, "/v1/suppressions/patient@example.com", ""); res.Code != http.StatusNoContent {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusNoContent)
+	}
+	if res := serve(http.MethodGet, "/v1/suppressions/patient@example.com", ""); res.Code != http.StatusNotFound {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusNotFound)
+	}
+}
@@ -1,38 +1,103 @@
 package api
 
 import (
+	"encoding/json"
+	"io/fs"
+	"mime"
+	"net/http"
+	"strings"
+
 	"github.com/gorilla/mux"
 	"github.com/tidepool-org/mailer/templates"
 	"go.uber.org/zap"
-	"io/fs"
-	"net/http"
 )
 
-func TemplateSourcesHandler() (http.Handler, error) {
-	f, err := fs.Sub(templates.Sources, "sources")
-	if err != nil {
-		return nil, err
-	}
-	return http.FileServer(http.FS(f)), nil
+const (
+	// SubjectHeader holds the (RFC 2047 encoded) subject of the template rendered as html
+	SubjectHeader = "X-Tidepool-Email-Subject"
+
+	formatParam = "format"
+	formatHTML  = "html"
+	formatText  = "text"
+	formatJSON  = "json"
+)
+
+type RenderedTemplateResponse struct {
+	Subject   string                   `json:"subject"`
+	HTML      string                   `json:"html"`
+	Text      string                   `json:"text"`
+	Variables templates.VariableSchema `json:"variables"`
+}
+
+// TemplateSourcesHandler serves the template sources, i.e. the configured templates directory or the
+// embedded templates
+func TemplateSourcesHandler(sources fs.FS) http.Handler {
+	return http.FileServer(http.FS(sources))
 }
 
-func RenderedTemplatesHandler(logger *zap.SugaredLogger, tmplts templates.Templates) (http.HandlerFunc, error) {
-	return func (w http.ResponseWriter, r *http.Request) {
+// RenderedTemplatesHandler renders the template with the variables passed in the query string or in
+// the JSON object of a POST request body. The response format is selected with the "format" query
+// parameter (html, text or json) or by accepting application/json.
+func RenderedTemplatesHandler(logger *zap.SugaredLogger, tmplts templates.Catalog, globalVars *templates.GlobalVariables) (http.HandlerFunc, error) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := make(map[string]string)
+		for key, values := range r.URL.Query() {
+			if key != formatParam && len(values) > 0 {
+				vars[key] = values[0]
+			}
+		}
+		if r.Method == http.MethodPost {
+			body := make(map[string]string)
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+			for key, value := range body {
+				vars[key] = value
+			}
+		}
+
 		params := mux.Vars(r)
-		template, ok := tmplts[templates.TemplateName(params["name"])]
+		template, ok := tmplts.Lookup(templates.TemplateName(params["name"]), vars[templates.LocaleVariable])
 		if !ok {
 			w.WriteHeader(404)
 			return
 		}
-		result, err := template.Execute(nil)
+		result, err := template.Execute(globalVars.Merge(vars))
 		if err != nil {
 			w.WriteHeader(500)
 			logger.Error(err)
 			return
 		}
 
-		w.WriteHeader(200)
-		w.Header().Set("content-type", "text/html")
-		w.Write([]byte(result.Body))
+		switch responseFormat(r) {
+		case formatJSON:
+			writeJSON(w, http.StatusOK, RenderedTemplateResponse{
+				Subject:   result.Subject,
+				HTML:      result.Body,
+				Text:      result.TextBody,
+				Variables: template.Variables(),
+			})
+		case formatText:
+			w.Header().Set("content-type", "text/plain; charset=utf-8")
+			w.Header().Set(SubjectHeader, mime.QEncoding.Encode("utf-8", result.Subject))
+			w.WriteHeader(200)
+			w.Write([]byte(result.TextBody))
+		default:
+			w.Header().Set("content-type", "text/html; charset=utf-8")
+			w.Header().Set(SubjectHeader, mime.QEncoding.Encode("utf-8", result.Subject))
+			w.WriteHeader(200)
+			w.Write([]byte(result.Body))
+		}
 	}, nil
-}
\ No newline at end of file
+}
+
+func responseFormat(r *http.Request) string {
+	if format := r.URL.Query().Get(formatParam); format != "" {
+		return format
+	}
+	if strings.Contains(r.Header.Get("accept"), "application/json") {
+		return formatJSON
+	}
+	return formatHTML
+}
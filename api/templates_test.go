@@ -0,0 +1,98 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gorilla/mux"
+	"github.com/tidepool-org/mailer/api"
+	"github.com/tidepool-org/mailer/templates"
+	"go.uber.org/zap"
+)
+
+func newTestRenderedTemplatesRouter(t *testing.T) *mux.Router {
+	tmplts, err := templates.LoadFromFS(fstest.MapFS{
+		"greeting_subject.txt":    {Data: []byte(`Hello {{ .Name }}`)},
+		"greeting_body.html":      {Data: []byte(`<p>Hello {{ .Name }}</p><a href="{{ .WebURL }}/login">Log in</a>`)},
+		"greeting.es_subject.txt": {Data: []byte(`Hola {{ .Name }}`)},
+		"greeting.es_body.html":   {Data: []byte(`<p>Hola {{ .Name }}</p>`)},
+	})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	handler, err := api.RenderedTemplatesHandler(zap.NewNop().Sugar(), tmplts, &templates.GlobalVariables{WebAppUrl: "https://app.tidepool.org"})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/rendered/{name}", handler)
+	return router
+}
+
+func Test_RenderedTemplatesHandler_QueryVariables(t *testing.T) {
+	router := newTestRenderedTemplatesRouter(t)
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/rendered/greeting?Name=Jo", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusOK)
+	}
+	if subject := res.Header().Get(api.SubjectHeader); subject != "Hello Jo" {
+		t.Errorf(`Subject header is "%s", but should be "Hello Jo"`, subject)
+	}
+	if !strings.Contains(res.Body.String(), `<a href="https://app.tidepool.org/login">`) {
+		t.Errorf(`Body doesn't contain the web app url: %s`, res.Body.String())
+	}
+}
+
+func Test_RenderedTemplatesHandler_JSON(t *testing.T) {
+	router := newTestRenderedTemplatesRouter(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/rendered/greeting?format=json", strings.NewReader(`{"Name": "Jo", "Locale": "es-MX"}`))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusOK)
+	}
+
+	result := api.RenderedTemplateResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	expected := api.RenderedTemplateResponse{Subject: "Hola Jo", HTML: "<html><head></head><body><p>Hola Jo</p></body></html>", Text: "Hola Jo",
+		Variables: templates.VariableSchema{Required: []string{"Name"}, Optional: []string{}}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf(`Result is %v, but should be %v`, result, expected)
+	}
+}
+
+func Test_RenderedTemplatesHandler_NotFound(t *testing.T) {
+	router := newTestRenderedTemplatesRouter(t)
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/rendered/missing", nil))
+	if res.Code != http.StatusNotFound {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusNotFound)
+	}
+}
+
+func Test_TemplateSourcesHandler(t *testing.T) {
+	handler := api.TemplateSourcesHandler(fstest.MapFS{
+		"css/styles.css": {Data: []byte(`p { color: #123456; }`)},
+	})
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/css/styles.css", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusOK)
+	}
+	if body := res.Body.String(); body != `p { color: #123456; }` {
+		t.Errorf(`Body is "%s", but should be the stylesheet`, body)
+	}
+}
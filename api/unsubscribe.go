@@ -0,0 +1,85 @@
+package api
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/tidepool-org/mailer/consumer"
+	"go.uber.org/zap"
+)
+
+const unsubscribedMessage = "You have been unsubscribed from Tidepool reminder emails.\n"
+
+// unsubscribeConfirmation is rendered when the recipient follows the unsubscribe link of the email body.
+// The opt-out is only recorded when the form is submitted, because mail scanners and link previews
+// follow the links of emails.
+var unsubscribeConfirmation = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Unsubscribe</title>
+</head>
+<body>
+<p>Do you want to unsubscribe {{ .Email }} from Tidepool reminder emails?</p>
+<form method="post">
+<input type="hidden" name="{{ .EmailParameter }}" value="{{ .Email }}">
+<input type="hidden" name="{{ .SignatureParameter }}" value="{{ .Signature }}">
+<button type="submit">Unsubscribe</button>
+</form>
+</body>
+</html>
+`))
+
+// UnsubscribeHandler records the opt-out of the recipient of a marketing email. GET requests are sent when the
+// recipient follows the link in the email body, they render a confirmation form which is submitted with a POST
+// request. POST requests are also sent by one-click unsubscribes (RFC 8058). The handler is nil if the
+// unsubscribe urls are not configured.
+func UnsubscribeHandler(logger *zap.SugaredLogger, signer *consumer.UnsubscribeSigner, suppressions consumer.SuppressionStore) (http.HandlerFunc, error) {
+	if signer == nil {
+		return nil, nil
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := r.FormValue(consumer.UnsubscribeEmailParameter)
+		signature := r.FormValue(consumer.UnsubscribeSignatureParameter)
+		if email == "" || signature == "" {
+			http.Error(w, "email and signature are required", http.StatusBadRequest)
+			return
+		}
+		if !signer.Verify(email, signature) {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("content-type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			err := unsubscribeConfirmation.Execute(w, map[string]string{
+				"Email":              email,
+				"Signature":          signature,
+				"EmailParameter":     consumer.UnsubscribeEmailParameter,
+				"SignatureParameter": consumer.UnsubscribeSignatureParameter,
+			})
+			if err != nil {
+				logger.Errorw("Unable to render unsubscribe confirmation", "error", err)
+			}
+			return
+		}
+
+		err := suppressions.Add(r.Context(), consumer.Suppression{
+			Email:  email,
+			Reason: consumer.SuppressionReasonUnsubscribed,
+		})
+		if err != nil {
+			logger.Errorw("Unable to record unsubscribe", "error", err)
+			http.Error(w, "unable to unsubscribe", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Infow("Recipient unsubscribed from marketing emails")
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(unsubscribedMessage))
+	}, nil
+}
@@ -0,0 +1,105 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tidepool-org/mailer/api"
+	"github.com/tidepool-org/mailer/consumer"
+	"go.uber.org/zap"
+)
+
+func newTestUnsubscribeHandler(t *testing.T) (http.HandlerFunc, *consumer.UnsubscribeSigner, *consumer.MemorySuppressionStore) {
+	signer, err := consumer.NewUnsubscribeSignerFromConfig(&consumer.UnsubscribeConfig{URL: "https://api.tidepool.org/v1/unsubscribe", Secret: "secret"})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	suppressions := consumer.NewMemorySuppressionStore()
+	handler, err := api.UnsubscribeHandler(zap.NewNop().Sugar(), signer, suppressions)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	return handler, signer, suppressions
+}
+
+func Test_UnsubscribeHandler_OneClick(t *testing.T) {
+	handler, signer, suppressions := newTestUnsubscribeHandler(t)
+
+	req := httptest.NewRequest(http.MethodPost, signer.URL("patient@example.com"), strings.NewReader("List-Unsubscribe=One-Click"))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusOK)
+	}
+
+	suppression, err := suppressions.Get(context.Background(), "patient@example.com")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if suppression == nil || suppression.Reason != consumer.SuppressionReasonUnsubscribed {
+		t.Fatalf(`Suppression is %v, but the recipient should be unsubscribed`, suppression)
+	}
+}
+
+func Test_UnsubscribeHandler_InvalidSignature(t *testing.T) {
+	handler, signer, suppressions := newTestUnsubscribeHandler(t)
+
+	signed, _ := url.Parse(signer.URL("patient@example.com"))
+	query := signed.Query()
+	query.Set("email", "other@example.com")
+	signed.RawQuery = query.Encode()
+
+	req := httptest.NewRequest(http.MethodGet, signed.String(), nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusForbidden {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusForbidden)
+	}
+	if suppression, _ := suppressions.Get(context.Background(), "other@example.com"); suppression != nil {
+		t.Fatalf(`Suppression is %v, but should be nil`, suppression)
+	}
+}
+
+func Test_UnsubscribeHandler_Confirmation(t *testing.T) {
+	handler, signer, suppressions := newTestUnsubscribeHandler(t)
+
+	req := httptest.NewRequest(http.MethodGet, signer.URL("patient@example.com"), nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusOK)
+	}
+	if body := res.Body.String(); !strings.Contains(body, `<form method="post">`) || !strings.Contains(body, `value="patient@example.com"`) {
+		t.Fatalf(`Body should contain the confirmation form, got %s`, body)
+	}
+	if suppression, _ := suppressions.Get(context.Background(), "patient@example.com"); suppression != nil {
+		t.Fatalf(`Suppression is %v, but should be nil until the form is submitted`, suppression)
+	}
+
+	signed, _ := url.Parse(signer.URL("patient@example.com"))
+	req = httptest.NewRequest(http.MethodPost, "/v1/unsubscribe", strings.NewReader(signed.RawQuery))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf(`Status is %v, but should be %v`, res.Code, http.StatusOK)
+	}
+	if suppression, _ := suppressions.Get(context.Background(), "patient@example.com"); suppression == nil || suppression.Reason != consumer.SuppressionReasonUnsubscribed {
+		t.Fatalf(`Suppression is %v, but the recipient should be unsubscribed`, suppression)
+	}
+}
+
+func Test_UnsubscribeHandler_NotConfigured(t *testing.T) {
+	handler, err := api.UnsubscribeHandler(zap.NewNop().Sugar(), nil, consumer.NewMemorySuppressionStore())
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if handler != nil {
+		t.Fatal("Handler should be nil if unsubscribe urls are not configured")
+	}
+}
@@ -0,0 +1,103 @@
+package consumer
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// IdempotencyKeyVariable is the name of the optional event variable which overrides the key used
+// to detect duplicate events. By default, events are deduplicated by their CloudEvent source and id.
+// The override is scoped to the CloudEvent source too, so producers can't drop each other's emails.
+const IdempotencyKeyVariable = "IdempotencyKey"
+
+// DeduplicationStore records the keys of successfully handled events
+type DeduplicationStore interface {
+	// Contains returns true if the key was recorded and hasn't expired yet
+	Contains(ctx context.Context, key string) (bool, error)
+	// Add records the key
+	Add(ctx context.Context, key string) error
+}
+
+type DeduplicationConfig struct {
+	Capacity int           `envconfig:"TIDEPOOL_MAILER_DEDUPLICATION_CAPACITY" default:"10000"`
+	TTL      time.Duration `envconfig:"TIDEPOOL_MAILER_DEDUPLICATION_TTL" default:"24h"`
+}
+
+func NewDeduplicationStore() (DeduplicationStore, error) {
+	cfg := &DeduplicationConfig{}
+	if err := envconfig.Process("", cfg); err != nil {
+		return nil, err
+	}
+	return NewMemoryDeduplicationStore(cfg), nil
+}
+
+// MemoryDeduplicationStore is an in-memory LRU cache of keys which expire after the configured TTL.
+// The least recently used keys are evicted when the capacity is reached.
+type MemoryDeduplicationStore struct {
+	capacity int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+type deduplicationEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+var _ DeduplicationStore = &MemoryDeduplicationStore{}
+
+func NewMemoryDeduplicationStore(cfg *DeduplicationConfig) *MemoryDeduplicationStore {
+	return &MemoryDeduplicationStore{
+		capacity: cfg.Capacity,
+		ttl:      cfg.TTL,
+		entries:  list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+func (m *MemoryDeduplicationStore) Contains(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.index[key]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(element.Value.(*deduplicationEntry).expiresAt) {
+		m.remove(element)
+		return false, nil
+	}
+
+	m.entries.MoveToFront(element)
+	return true, nil
+}
+
+func (m *MemoryDeduplicationStore) Add(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expiresAt := time.Now().Add(m.ttl)
+	if element, ok := m.index[key]; ok {
+		element.Value.(*deduplicationEntry).expiresAt = expiresAt
+		m.entries.MoveToFront(element)
+		return nil
+	}
+
+	m.index[key] = m.entries.PushFront(&deduplicationEntry{key: key, expiresAt: expiresAt})
+	for m.capacity > 0 && m.entries.Len() > m.capacity {
+		m.remove(m.entries.Back())
+	}
+	return nil
+}
+
+func (m *MemoryDeduplicationStore) remove(element *list.Element) {
+	m.entries.Remove(element)
+	delete(m.index, element.Value.(*deduplicationEntry).key)
+}
@@ -0,0 +1,44 @@
+package consumer_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/mailer/consumer"
+)
+
+func Test_MemoryDeduplicationStore_Expiration(t *testing.T) {
+	store := consumer.NewMemoryDeduplicationStore(&consumer.DeduplicationConfig{Capacity: 10, TTL: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	if err := store.Add(ctx, "key"); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if ok, _ := store.Contains(ctx, "key"); !ok {
+		t.Fatal("Store should contain the key")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := store.Contains(ctx, "key"); ok {
+		t.Fatal("Key should have expired")
+	}
+}
+
+func Test_MemoryDeduplicationStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	store := consumer.NewMemoryDeduplicationStore(&consumer.DeduplicationConfig{Capacity: 2, TTL: time.Hour})
+	ctx := context.Background()
+
+	_ = store.Add(ctx, "first")
+	_ = store.Add(ctx, "second")
+	// Using the first key makes the second one the least recently used
+	_, _ = store.Contains(ctx, "first")
+	_ = store.Add(ctx, "third")
+
+	expected := map[string]bool{"first": true, "second": false, "third": true}
+	for key, expectedContains := range expected {
+		if ok, _ := store.Contains(ctx, key); ok != expectedContains {
+			t.Errorf(`Contains("%s") is %v, but should be %v`, key, ok, expectedContains)
+		}
+	}
+}
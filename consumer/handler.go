@@ -2,79 +2,479 @@ package consumer
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
 	"github.com/go-playground/validator/v10"
 	"github.com/tidepool-org/go-common/events"
 	"github.com/tidepool-org/mailer/mailer"
 	"github.com/tidepool-org/mailer/templates"
 	"go.uber.org/zap"
+	"strings"
 	"time"
 )
 
 const timeout = time.Second * 30
 
+const (
+	// DeadLetterReasonExtension holds the reason the event was sent to the dead letters topic
+	DeadLetterReasonExtension = "deadletterreason"
+	// DeadLetterAttemptsExtension holds the number of unsuccessful attempts to send the email, including the
+	// attempts of previous deliveries of the event
+	DeadLetterAttemptsExtension = "deadletterattempts"
+	// DeadLetterRetryableExtension is true if the event failed transiently and can be replayed as is
+	DeadLetterRetryableExtension = "deadletterretryable"
+)
+
+var (
+	ErrInvalidEvent     = errors.New("invalid event")
+	ErrUnknownTemplate  = errors.New("unknown template")
+	ErrInvalidRecipient = errors.New("invalid recipient")
+	ErrRenderTemplate   = errors.New("unable to render template")
+	ErrMissingVariables = errors.New("missing required variables")
+	ErrInvalidHeaders   = errors.New("invalid headers")
+	// ErrRecipientSuppressed is returned when the email isn't sent, because the recipient is suppressed.
+	// It's not a failure of the event.
+	ErrRecipientSuppressed = errors.New("recipient is suppressed")
+)
+
+// SendEmailTemplatePayload extends the send email template event with optional additional recipients
+// and headers. The email is addressed to the event recipient and the additional To recipients, marketing
+// emails can't have additional recipients. The
+// reply-to address and the headers override the defaults from the template metadata. Source is the
+// source of the event (or the api), it's added to the email as the event source tag.
+type SendEmailTemplatePayload struct {
+	events.SendEmailTemplateEvent
+	To      []string          `json:"to,omitempty"`
+	Cc      []string          `json:"cc,omitempty"`
+	Bcc     []string          `json:"bcc,omitempty"`
+	ReplyTo string            `json:"reply_to,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Source  string            `json:"-"`
+	// Attachments shadow the attachments of the event, so they can be referenced instead of embedded
+	Attachments []EmailAttachment `json:"attachments,omitempty"`
+}
+
+// EmailAttachment extends the email attachment of the event with an optional reference, e.g.
+// https://reports.tidepool.org/report.pdf or s3://bucket/report.pdf, which is fetched when the
+// email is sent. The data must be empty if the attachment is referenced.
+type EmailAttachment struct {
+	events.EmailAttachment
+	Reference string `json:"reference,omitempty"`
+}
+
+// DeadLetterProducer publishes events which can't be delivered
+type DeadLetterProducer interface {
+	SendCloudEvent(ctx context.Context, event cloudevents.Event) error
+}
+
 type EmailEventHandler struct {
-	globalVars *templates.GlobalVariables
-	logger     *zap.SugaredLogger
-	mailer     mailer.Mailer
-	tmplts     templates.Templates
-	validate   *validator.Validate
+	attachments   *mailer.AttachmentValidator
+	deadLetters   DeadLetterProducer
+	deduplication DeduplicationStore
+	fetcher       mailer.AttachmentFetcher
+	globalVars    *templates.GlobalVariables
+	logger        *zap.SugaredLogger
+	mailer        mailer.Mailer
+	senders       *mailer.SenderAllowList
+	suppressions  SuppressionStore
+	tmplts        templates.Catalog
+	unsubscribe   *UnsubscribeSigner
+	validate      *validator.Validate
 }
 
 var _ events.EmailEventHandler = &EmailEventHandler{}
+var _ events.EventHandler = &EmailEventHandler{}
+
+type EmailEventHandlerParams struct {
+	// Attachments is optional, the default attachment limits are used if it's not set
+	Attachments *mailer.AttachmentValidator
+	// DeadLetters is optional, permanently failed events are dropped if it's not set
+	DeadLetters   DeadLetterProducer
+	Deduplication DeduplicationStore
+	// Fetcher is optional, referenced attachments are rejected if it's not set
+	Fetcher    mailer.AttachmentFetcher
+	GlobalVars *templates.GlobalVariables
+	Logger     *zap.SugaredLogger
+	Mailer     mailer.Mailer
+	// Senders is optional, emails with a template sender are rejected if it's not set
+	Senders *mailer.SenderAllowList
+	// Suppressions is optional, emails are sent to all recipients if it's not set
+	Suppressions SuppressionStore
+	Templates    templates.Catalog
+	// Unsubscribe is optional, marketing emails are sent without unsubscribe urls if it's not set
+	Unsubscribe *UnsubscribeSigner
+}
+
+func NewEmailEventHandler(params *EmailEventHandlerParams) (*EmailEventHandler, error) {
+	validate := validator.New()
+	attachments := params.Attachments
+	if attachments == nil {
+		var err error
+		if attachments, err = mailer.NewAttachmentValidator(validate); err != nil {
+			return nil, err
+		}
+	}
 
-func NewEmailEventHandler(logger *zap.SugaredLogger, mailer mailer.Mailer, tmplts templates.Templates, globalVars *templates.GlobalVariables) (*EmailEventHandler, error) {
 	return &EmailEventHandler{
-		globalVars: globalVars,
-		logger:     logger,
-		mailer:     mailer,
-		tmplts:     tmplts,
-		validate:   validator.New(),
+		attachments:   attachments,
+		deadLetters:   params.DeadLetters,
+		deduplication: params.Deduplication,
+		fetcher:       params.Fetcher,
+		globalVars:    params.GlobalVars,
+		logger:        params.Logger,
+		mailer:        params.Mailer,
+		senders:       params.Senders,
+		suppressions:  params.Suppressions,
+		tmplts:        params.Templates,
+		unsubscribe:   params.Unsubscribe,
+		validate:      validate,
 	}, nil
 }
 
+func (e *EmailEventHandler) CanHandle(ce cloudevents.Event) bool {
+	return ce.Type() == events.SendEmailTemplateEventType
+}
+
+// Handle sends the email requested by the event. Failures are published to the dead letters topic with
+// the failure reason and the number of attempts. Transient failures, which remain after the backend
+// retries, are marked as retryable, because the consumer doesn't redeliver events.
+func (e *EmailEventHandler) Handle(ce cloudevents.Event) error {
+	payload := SendEmailTemplatePayload{}
+	err := ce.DataAs(&payload)
+	if err != nil {
+		err = mailer.NewPermanentError(fmt.Errorf("%w: %w", ErrInvalidEvent, err))
+	} else {
+		payload.Source = ce.Source()
+		key := deduplicationKey(ce, payload)
+		if e.isDuplicate(key) {
+			ObserveDuplicateEvent()
+			e.logger.Infow("Skipping event because an email was already sent for it", "id", ce.ID(), "key", key)
+			return nil
+		}
+		if err = e.handleSendEmailTemplate(payload); err == nil {
+			e.recordSent(key)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	reason := failureReason(err)
+	permanent := mailer.IsPermanent(err)
+	ObserveFailedEvent(reason, permanent)
+	if permanent {
+		e.logger.Warnw("Permanent failure while handling event", "id", ce.ID(), "reason", reason, "error", err)
+	} else {
+		e.logger.Errorw("Transient failure while handling event", "id", ce.ID(), "reason", reason, "error", err)
+	}
+	// The consumer publishes the event to the dead letters topic again if the error is returned
+	return e.publishDeadLetter(ce, err, !permanent)
+}
+
 func (e *EmailEventHandler) HandleSendEmailTemplate(payload events.SendEmailTemplateEvent) error {
-	tmplt, ok := e.tmplts[templates.TemplateName(payload.Template)]
-	if !ok {
-		e.logger.Infof("Skipping email to %s because template %s doesn't exist", payload.Recipient, payload.Template)
+	attachments := make([]EmailAttachment, len(payload.Attachments))
+	for i, attachment := range payload.Attachments {
+		attachments[i] = EmailAttachment{EmailAttachment: attachment}
+	}
+	return e.handleSendEmailTemplate(SendEmailTemplatePayload{SendEmailTemplateEvent: payload, Attachments: attachments})
+}
+
+func (e *EmailEventHandler) handleSendEmailTemplate(payload SendEmailTemplatePayload) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := e.SendEmailTemplate(ctx, payload)
+	if errors.Is(err, ErrRecipientSuppressed) {
 		return nil
 	}
+	return err
+}
+
+// SendEmailTemplate renders and sends the email requested by the payload and returns the message id
+// assigned by the mailer backend. ErrRecipientSuppressed is returned if the recipient is suppressed.
+func (e *EmailEventHandler) SendEmailTemplate(ctx context.Context, payload SendEmailTemplatePayload) (string, error) {
+	locale := payload.Variables[templates.LocaleVariable]
+	tmplt, ok := e.tmplts.Lookup(templates.TemplateName(payload.Template), locale)
+	if !ok {
+		return "", mailer.NewPermanentError(fmt.Errorf("%w %s", ErrUnknownTemplate, payload.Template))
+	}
 
 	if err := e.validate.Var(payload.Recipient, "required,email"); err != nil {
-		err = fmt.Errorf("skipping sending email to %s. Validation failed: %w", payload.Recipient, err)
-		e.logger.Warn(zap.Error(err))
-		return nil
+		return "", mailer.NewPermanentError(fmt.Errorf("%w %s: %w", ErrInvalidRecipient, payload.Recipient, err))
+	}
+	for _, recipients := range [][]string{payload.To, payload.Cc, payload.Bcc} {
+		for _, recipient := range recipients {
+			if err := e.validate.Var(recipient, "required,email"); err != nil {
+				return "", mailer.NewPermanentError(fmt.Errorf("%w %s: %w", ErrInvalidRecipient, recipient, err))
+			}
+		}
+	}
+
+	if payload.ReplyTo != "" {
+		if err := e.validate.Var(payload.ReplyTo, "email"); err != nil {
+			return "", mailer.NewPermanentError(fmt.Errorf("%w: reply-to %s: %w", ErrInvalidHeaders, payload.ReplyTo, err))
+		}
+	}
+	if err := mailer.ValidateHeaders(payload.Headers); err != nil {
+		return "", mailer.NewPermanentError(fmt.Errorf("%w: %w", ErrInvalidHeaders, err))
+	}
+
+	// The unsubscribe url is signed for the recipient, so marketing emails can't be shared with other recipients
+	marketing := tmplt.Metadata().Category == templates.CategoryMarketing
+	if marketing && len(payload.To)+len(payload.Cc)+len(payload.Bcc) > 0 {
+		return "", mailer.NewPermanentError(fmt.Errorf("%w: marketing template %s must only be sent to the recipient", ErrInvalidRecipient, payload.Template))
+	}
+	if skip, err := e.removeSuppressedRecipients(ctx, &payload, marketing); err != nil {
+		return "", err
+	} else if skip {
+		ObserveSuppressedSend(payload.Template)
+		return "", ErrRecipientSuppressed
 	}
 
 	vars := MergeGlobalVars(payload.Variables, *e.globalVars)
+	var unsubscribeURL string
+	if marketing && e.unsubscribe != nil {
+		unsubscribeURL = e.unsubscribe.URL(payload.Recipient)
+		vars[UnsubscribeURLVariable] = unsubscribeURL
+	}
+	if missing := tmplt.Variables().Missing(vars); len(missing) > 0 {
+		ObserveMissingVariables(payload.Template)
+		return "", mailer.NewPermanentError(fmt.Errorf("%w of template %s: %s", ErrMissingVariables, payload.Template, strings.Join(missing, ", ")))
+	}
+
 	rendered, err := tmplt.Execute(vars)
 	if err != nil {
-		return err
+		return "", mailer.NewPermanentError(fmt.Errorf("%w: %w", ErrRenderTemplate, err))
+	}
+
+	if rendered.From != "" {
+		if e.senders == nil {
+			return "", mailer.NewPermanentError(fmt.Errorf("%w: %s", mailer.ErrSenderNotAllowed, rendered.From))
+		} else if err := e.senders.Validate(rendered.From); err != nil {
+			return "", mailer.NewPermanentError(err)
+		}
 	}
 
 	email := &mailer.Email{
-		Recipients:  []string{payload.Recipient},
-		Subject:     rendered.Subject,
-		Body:        rendered.Body,
-		Attachments: make([]mailer.Attachment, len(payload.Attachments)),
+		From:             rendered.From,
+		Recipients:       append([]string{payload.Recipient}, payload.To...),
+		Cc:               payload.Cc,
+		Bcc:              payload.Bcc,
+		Subject:          rendered.Subject,
+		Body:             rendered.Body,
+		TextBody:         rendered.TextBody,
+		ReplyTo:          rendered.ReplyTo,
+		Headers:          mailer.MergeHeaders(nil, rendered.Headers),
+		Attachments:      make([]mailer.Attachment, len(payload.Attachments)),
+		ConfigurationSet: tmplt.Metadata().ConfigurationSet,
+		Tags:             emailTags(payload),
 	}
+	if metadata := tmplt.Metadata(); metadata.ContactList != "" {
+		email.ListManagement = &mailer.ListManagement{ContactList: metadata.ContactList, Topic: metadata.Topic}
+	}
+	if payload.ReplyTo != "" {
+		email.ReplyTo = payload.ReplyTo
+	}
+	email.Headers = mailer.MergeHeaders(email.Headers, payload.Headers)
+	email.UnsubscribeURL = unsubscribeURL
 	for i, attachment := range payload.Attachments {
+		data, err := e.attachmentData(ctx, attachment)
+		if err != nil {
+			return "", err
+		}
 		email.Attachments[i] = mailer.Attachment{
 			ContentType: attachment.ContentType,
-			Data:        attachment.Data,
+			Data:        data,
 			Filename:    attachment.Filename,
 		}
 	}
+	for _, image := range rendered.InlineImages {
+		email.Attachments = append(email.Attachments, mailer.Attachment{
+			ContentType: image.ContentType,
+			Data:        base64.StdEncoding.EncodeToString(image.Data),
+			Filename:    image.Name,
+			Disposition: mailer.DispositionInline,
+			ContentID:   image.ContentID,
+		})
+	}
+	if err := e.attachments.Validate(email); err != nil {
+		return "", mailer.NewPermanentError(err)
+	}
 
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
 	return e.mailer.Send(ctx, email)
 }
 
-func MergeGlobalVars(vars map[string]string, global templates.GlobalVariables) map[string]string {
-	if vars == nil {
-		vars = make(map[string]string)
+// attachmentData returns the base64 encoded data of the attachment and fetches referenced attachments
+func (e *EmailEventHandler) attachmentData(ctx context.Context, attachment EmailAttachment) (string, error) {
+	if attachment.Reference == "" {
+		return attachment.Data, nil
+	}
+	if attachment.Data != "" {
+		return "", mailer.NewPermanentError(fmt.Errorf("%w %s: data and reference are mutually exclusive", mailer.ErrInvalidAttachment, attachment.Filename))
+	}
+	if e.fetcher == nil {
+		return "", mailer.NewPermanentError(fmt.Errorf("%w: attachments can't be fetched", mailer.ErrInvalidAttachmentReference))
+	}
+
+	data, err := e.fetcher.Fetch(ctx, attachment.Reference)
+	if errors.Is(err, mailer.ErrInvalidAttachmentReference) || errors.Is(err, mailer.ErrAttachmentUnavailable) || errors.Is(err, mailer.ErrAttachmentTooLarge) {
+		return "", mailer.NewPermanentError(err)
+	} else if err != nil {
+		return "", fmt.Errorf("unable to fetch attachment %s: %w", attachment.Filename, err)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// emailTags returns the tags which identify the template and the source of the email. The values are
+// sanitized, because event sources are usually URIs.
+func emailTags(payload SendEmailTemplatePayload) map[string]string {
+	tags := map[string]string{
+		mailer.TagTemplate: mailer.SanitizeTagValue(payload.Template),
+	}
+	if source := mailer.SanitizeTagValue(payload.Source); source != "" {
+		tags[mailer.TagEventSource] = source
+	}
+	return tags
+}
+
+// removeSuppressedRecipients removes the additional recipients which are suppressed. It returns true
+// if the email must not be sent, because the primary recipient is suppressed.
+func (e *EmailEventHandler) removeSuppressedRecipients(ctx context.Context, payload *SendEmailTemplatePayload, marketing bool) (bool, error) {
+	if e.suppressions == nil {
+		return false, nil
+	}
+
+	suppressed, err := e.isSuppressed(ctx, payload.Template, payload.Recipient, marketing)
+	if err != nil || suppressed {
+		return suppressed, err
+	}
+
+	for _, recipients := range []*[]string{&payload.To, &payload.Cc, &payload.Bcc} {
+		allowed := make([]string, 0, len(*recipients))
+		for _, recipient := range *recipients {
+			suppressed, err := e.isSuppressed(ctx, payload.Template, recipient, marketing)
+			if err != nil {
+				return false, err
+			} else if !suppressed {
+				allowed = append(allowed, recipient)
+			}
+		}
+		*recipients = allowed
+	}
+	return false, nil
+}
+
+func (e *EmailEventHandler) isSuppressed(ctx context.Context, template string, recipient string, marketing bool) (bool, error) {
+	suppression, err := e.suppressions.Get(ctx, recipient)
+	if err != nil {
+		return false, fmt.Errorf("unable to check if recipient is suppressed: %w", err)
+	}
+	if suppression == nil || !suppression.Applies(marketing) {
+		return false, nil
+	}
+
+	ObserveSuppressedRecipient(template, string(suppression.Reason))
+	e.logger.Infow("Skipping suppressed recipient", "template", template, "reason", suppression.Reason)
+	return true, nil
+}
+
+func deduplicationKey(ce cloudevents.Event, payload SendEmailTemplatePayload) string {
+	if key := payload.Variables[IdempotencyKeyVariable]; key != "" {
+		return fmt.Sprintf("%s/%s", ce.Source(), key)
+	}
+	return fmt.Sprintf("%s/%s", ce.Source(), ce.ID())
+}
+
+func (e *EmailEventHandler) isDuplicate(key string) bool {
+	if e.deduplication == nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	duplicate, err := e.deduplication.Contains(ctx, key)
+	if err != nil {
+		// Prefer sending a duplicate to not sending the email at all
+		e.logger.Errorw("Unable to check if event is a duplicate", "key", key, "error", err)
+		return false
 	}
-	vars["AssetURL"] = global.AssetUrl
-	vars["WebURL"] = global.WebAppUrl
-	return vars
+	return duplicate
+}
+
+func (e *EmailEventHandler) recordSent(key string) {
+	if e.deduplication == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.deduplication.Add(ctx, key); err != nil {
+		e.logger.Errorw("Unable to record sent email", "key", key, "error", err)
+	}
+}
+
+// publishDeadLetter records the attempts of previous deliveries of the event and the attempts of the mailer
+func (e *EmailEventHandler) publishDeadLetter(ce cloudevents.Event, cause error, retryable bool) error {
+	if e.deadLetters == nil {
+		e.logger.Errorw("Dropping failed event because dead letters are disabled", "id", ce.ID(), "error", cause)
+		return nil
+	}
+
+	attempts := int32(0)
+	if value, ok := ce.Extensions()[DeadLetterAttemptsExtension]; ok {
+		attempts, _ = types.ToInteger(value)
+	}
+
+	deadLetter := ce.Clone()
+	deadLetter.SetExtension(DeadLetterReasonExtension, cause.Error())
+	deadLetter.SetExtension(DeadLetterAttemptsExtension, attempts+int32(mailer.Attempts(cause)))
+	deadLetter.SetExtension(DeadLetterRetryableExtension, retryable)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.deadLetters.SendCloudEvent(ctx, deadLetter); err != nil {
+		e.logger.Errorw("Failed to publish event to dead letters topic", "id", ce.ID(), "error", err)
+		return fmt.Errorf("unable to publish event %s to dead letters topic: %w", ce.ID(), err)
+	}
+	return nil
+}
+
+func failureReason(err error) string {
+	var backendErr *mailer.BackendError
+	switch {
+	case errors.Is(err, ErrInvalidEvent):
+		return "invalid_event"
+	case errors.Is(err, ErrUnknownTemplate):
+		return "unknown_template"
+	case errors.Is(err, ErrInvalidRecipient):
+		return "invalid_recipient"
+	case errors.Is(err, ErrRenderTemplate):
+		return "render_failure"
+	case errors.Is(err, ErrMissingVariables):
+		return "missing_variables"
+	case errors.Is(err, ErrInvalidHeaders):
+		return "invalid_headers"
+	case errors.Is(err, mailer.ErrSenderNotAllowed):
+		return "sender_not_allowed"
+	case errors.Is(err, mailer.ErrInvalidAttachment):
+		return "invalid_attachment"
+	case errors.Is(err, mailer.ErrAttachmentTooLarge):
+		return "attachment_too_large"
+	case errors.Is(err, mailer.ErrInvalidAttachmentReference):
+		return "invalid_attachment_reference"
+	case errors.Is(err, mailer.ErrAttachmentUnavailable):
+		return "attachment_unavailable"
+	case errors.As(err, &backendErr):
+		return "backend_error"
+	case mailer.IsPermanent(err):
+		return "invalid_message"
+	default:
+		return "unknown"
+	}
+}
+
+func MergeGlobalVars(vars map[string]string, global templates.GlobalVariables) map[string]string {
+	return global.Merge(vars)
 }
@@ -0,0 +1,682 @@
+package consumer_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"html"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/tidepool-org/go-common/events"
+	"github.com/tidepool-org/mailer/consumer"
+	"github.com/tidepool-org/mailer/mailer"
+	"github.com/tidepool-org/mailer/templates"
+	"go.uber.org/zap"
+)
+
+type fakeMailer struct {
+	err  error
+	sent []*mailer.Email
+}
+
+func (f *fakeMailer) Send(ctx context.Context, email *mailer.Email) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	f.sent = append(f.sent, email)
+	return "message-id", nil
+}
+
+type fakeDeadLetterProducer struct {
+	err       error
+	published []cloudevents.Event
+}
+
+func (f *fakeDeadLetterProducer) SendCloudEvent(ctx context.Context, event cloudevents.Event) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.published = append(f.published, event)
+	return nil
+}
+
+func newTestHandler(t *testing.T, m mailer.Mailer, deadLetters consumer.DeadLetterProducer) *consumer.EmailEventHandler {
+	return newTestHandlerWithParams(t, &consumer.EmailEventHandlerParams{DeadLetters: deadLetters, Mailer: m})
+}
+
+// newTestHandlerWithParams creates a handler with the test templates, the other params are optional
+func newTestHandlerWithParams(t *testing.T, params *consumer.EmailEventHandlerParams) *consumer.EmailEventHandler {
+	tmplts, err := templates.LoadFromFS(fstest.MapFS{
+		"clinic_subject.txt":     {Data: []byte(`Clinic update`)},
+		"clinic_body.html":       {Data: []byte(`<p>Clinic update</p>`)},
+		"clinic_metadata.json":   {Data: []byte(`{"from": "Tidepool Clinics <clinics@tidepool.org>", "configuration_set": "clinics"}`)},
+		"greeting_subject.txt":   {Data: []byte(`Hello {{ .Name }}`)},
+		"greeting_body.html":     {Data: []byte(`<p>Hello {{ .Name }}</p>`)},
+		"greeting_metadata.json": {Data: []byte(`{"reply_to": "support@tidepool.org", "headers": {"X-Tidepool-Category": "greeting"}}`)},
+		"reminder_subject.txt":   {Data: []byte(`Reminder`)},
+		"reminder_body.html":     {Data: []byte(`<p>Reminder</p><a href="{{ .UnsubscribeURL }}">Unsubscribe</a>`)},
+		"reminder_metadata.json": {Data: []byte(`{"category": "marketing"}`)},
+		"welcome_subject.txt":    {Data: []byte(`Welcome`)},
+		"welcome_body.html":      {Data: []byte("<img src=\"{{ inlineImage `logo.png` }}\"><p>Welcome</p>")},
+		"img/logo.png":           {Data: []byte("\x89PNG\r\n\x1a\n")},
+	})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	params.Templates = tmplts
+	if params.Deduplication == nil {
+		params.Deduplication = consumer.NewMemoryDeduplicationStore(&consumer.DeduplicationConfig{Capacity: 10, TTL: time.Hour})
+	}
+	params.GlobalVars = &templates.GlobalVariables{}
+	params.Logger = zap.NewNop().Sugar()
+
+	handler, err := consumer.NewEmailEventHandler(params)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	return handler
+}
+
+func newTestEvent(t *testing.T, payload interface{}) cloudevents.Event {
+	ce := cloudevents.NewEvent()
+	ce.SetID("event-id")
+	ce.SetSource("test")
+	ce.SetType(events.SendEmailTemplateEventType)
+	if err := ce.SetData(cloudevents.ApplicationJSON, payload); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	return ce
+}
+
+func Test_EmailEventHandler_Handle_Success(t *testing.T) {
+	m := &fakeMailer{}
+	deadLetters := &fakeDeadLetterProducer{}
+	handler := newTestHandler(t, m, deadLetters)
+
+	ce := newTestEvent(t, events.SendEmailTemplateEvent{
+		Recipient: "patient@example.com",
+		Template:  "greeting",
+		Variables: map[string]string{"Name": "Jo"},
+	})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 || m.sent[0].Subject != "Hello Jo" {
+		t.Fatalf(`Expected a single email with subject "Hello Jo", got %v`, m.sent)
+	}
+	if len(deadLetters.published) != 0 {
+		t.Fatalf(`Expected no dead letters, got %v`, len(deadLetters.published))
+	}
+}
+
+func Test_EmailEventHandler_Handle_ConfigurationSetAndTags(t *testing.T) {
+	senders, err := mailer.NewSenderAllowListFromConfig(&mailer.SenderAllowListConfig{
+		SenderAddress:  "noreply@tidepool.org",
+		AllowedSenders: []string{"clinics@tidepool.org"},
+	})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	m := &fakeMailer{}
+	handler := newTestHandlerWithParams(t, &consumer.EmailEventHandlerParams{Mailer: m, Senders: senders})
+
+	ce := newTestEvent(t, events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "clinic"})
+	ce.SetSource("https://tidepool.org/clinic")
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf(`Expected a single email, got %v`, m.sent)
+	}
+	if m.sent[0].ConfigurationSet != "clinics" {
+		t.Errorf(`Configuration set is "%s", but should be "clinics"`, m.sent[0].ConfigurationSet)
+	}
+	expected := map[string]string{mailer.TagTemplate: "clinic", mailer.TagEventSource: "https___tidepool_org_clinic"}
+	if !maps.Equal(m.sent[0].Tags, expected) {
+		t.Errorf(`Tags are %v, but should be %v`, m.sent[0].Tags, expected)
+	}
+	if err := mailer.ValidateTags(m.sent[0].Tags); err != nil {
+		t.Errorf(`Error is "%s", but should be nil`, err)
+	}
+}
+
+func Test_EmailEventHandler_Handle_InlineImages(t *testing.T) {
+	m := &fakeMailer{}
+	handler := newTestHandler(t, m, &fakeDeadLetterProducer{})
+
+	ce := newTestEvent(t, events.SendEmailTemplateEvent{
+		Recipient: "patient@example.com",
+		Template:  "welcome",
+		Attachments: []events.EmailAttachment{
+			{ContentType: "text/csv", Data: "YSxiCg==", Filename: "report.csv"},
+		},
+	})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf(`Expected a single email, got %v`, m.sent)
+	}
+	attachments := m.sent[0].Attachments
+	if len(attachments) != 2 || attachments[0].IsInline() {
+		t.Fatalf(`Attachments are %v, but should contain report.csv and the inline logo`, attachments)
+	}
+	expected := mailer.Attachment{
+		ContentType: "image/png",
+		Data:        "iVBORw0KGgo=",
+		Filename:    "logo.png",
+		Disposition: mailer.DispositionInline,
+		ContentID:   "logo.png@tidepool.org",
+	}
+	if attachments[1] != expected {
+		t.Errorf(`Inline attachment is %v, but should be %v`, attachments[1], expected)
+	}
+}
+
+func Test_EmailEventHandler_Handle_AttachmentReferences(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "reports"), 0o755); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "reports", "report.csv"), []byte("a,b\n"), 0o644); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	m := &fakeMailer{}
+	deadLetters := &fakeDeadLetterProducer{}
+	handler := newTestHandlerWithParams(t, &consumer.EmailEventHandlerParams{
+		DeadLetters: deadLetters,
+		Fetcher:     mailer.NewDirAttachmentFetcher(&mailer.AttachmentFetcherConfig{Dir: dir, MaxSize: 1024, AllowedBuckets: []string{"reports"}}),
+		Mailer:      m,
+	})
+
+	payload := consumer.SendEmailTemplatePayload{
+		SendEmailTemplateEvent: events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}},
+		Attachments: []consumer.EmailAttachment{
+			{EmailAttachment: events.EmailAttachment{ContentType: "text/csv", Filename: "report.csv"}, Reference: "s3://reports/report.csv"},
+		},
+	}
+	if err := handler.Handle(newTestEvent(t, payload)); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 || len(m.sent[0].Attachments) != 1 || m.sent[0].Attachments[0].Data != "YSxiCg==" {
+		t.Fatalf(`Expected a single email with the fetched attachment, got %v`, m.sent)
+	}
+
+	payload.Attachments[0].Reference = "s3://reports/missing.csv"
+	ce := newTestEvent(t, payload)
+	ce.SetID("missing-attachment-event-id")
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(deadLetters.published) != 1 {
+		t.Fatalf(`Expected a single dead letter, got %v`, len(deadLetters.published))
+	}
+}
+
+func Test_EmailEventHandler_Handle_AdditionalRecipients(t *testing.T) {
+	m := &fakeMailer{}
+	handler := newTestHandler(t, m, &fakeDeadLetterProducer{})
+
+	ce := newTestEvent(t, consumer.SendEmailTemplatePayload{
+		SendEmailTemplateEvent: events.SendEmailTemplateEvent{
+			Recipient: "patient@example.com",
+			Template:  "greeting",
+			Variables: map[string]string{"Name": "Jo"},
+		},
+		To:  []string{"caregiver@example.com"},
+		Cc:  []string{"clinic@example.com"},
+		Bcc: []string{"admin@example.com"},
+	})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf(`Expected a single email, got %v`, len(m.sent))
+	}
+	email := m.sent[0]
+	if !slices.Equal(email.Recipients, []string{"patient@example.com", "caregiver@example.com"}) {
+		t.Errorf(`Recipients are %v, but should be [patient@example.com caregiver@example.com]`, email.Recipients)
+	}
+	if !slices.Equal(email.Cc, []string{"clinic@example.com"}) {
+		t.Errorf(`Cc is %v, but should be [clinic@example.com]`, email.Cc)
+	}
+	if !slices.Equal(email.Bcc, []string{"admin@example.com"}) {
+		t.Errorf(`Bcc is %v, but should be [admin@example.com]`, email.Bcc)
+	}
+}
+
+func Test_EmailEventHandler_Handle_OverridesTemplateHeaders(t *testing.T) {
+	m := &fakeMailer{}
+	handler := newTestHandler(t, m, &fakeDeadLetterProducer{})
+
+	ce := newTestEvent(t, consumer.SendEmailTemplatePayload{
+		SendEmailTemplateEvent: events.SendEmailTemplateEvent{
+			Recipient: "patient@example.com",
+			Template:  "greeting",
+			Variables: map[string]string{"Name": "Jo"},
+		},
+		ReplyTo: "support@clinic.example.com",
+		Headers: map[string]string{"X-Tidepool-Clinic-Id": "clinic-123"},
+	})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf(`Expected a single email, got %v`, len(m.sent))
+	}
+	email := m.sent[0]
+	if email.ReplyTo != "support@clinic.example.com" {
+		t.Errorf(`Reply-to is "%s", but should be "support@clinic.example.com"`, email.ReplyTo)
+	}
+	expectedHeaders := map[string]string{"X-Tidepool-Category": "greeting", "X-Tidepool-Clinic-Id": "clinic-123"}
+	if !maps.Equal(email.Headers, expectedHeaders) {
+		t.Errorf(`Headers are %v, but should be %v`, email.Headers, expectedHeaders)
+	}
+}
+
+func Test_EmailEventHandler_Handle_OverridesTemplateHeadersRegardlessOfCase(t *testing.T) {
+	m := &fakeMailer{}
+	handler := newTestHandler(t, m, &fakeDeadLetterProducer{})
+
+	ce := newTestEvent(t, consumer.SendEmailTemplatePayload{
+		SendEmailTemplateEvent: events.SendEmailTemplateEvent{
+			Recipient: "patient@example.com",
+			Template:  "greeting",
+			Variables: map[string]string{"Name": "Jo"},
+		},
+		Headers: map[string]string{"x-tidepool-category": "reminder"},
+	})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf(`Expected a single email, got %v`, len(m.sent))
+	}
+	expectedHeaders := map[string]string{"X-Tidepool-Category": "reminder"}
+	if !maps.Equal(m.sent[0].Headers, expectedHeaders) {
+		t.Errorf(`Headers are %v, but should be %v`, m.sent[0].Headers, expectedHeaders)
+	}
+}
+
+func Test_EmailEventHandler_Handle_TemplateSender(t *testing.T) {
+	senders, err := mailer.NewSenderAllowListFromConfig(&mailer.SenderAllowListConfig{
+		SenderAddress:  "noreply@tidepool.org",
+		AllowedSenders: []string{"clinics@tidepool.org"},
+	})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	m := &fakeMailer{}
+	handler := newTestHandlerWithParams(t, &consumer.EmailEventHandlerParams{Mailer: m, Senders: senders})
+
+	ce := newTestEvent(t, events.SendEmailTemplateEvent{Recipient: "clinician@example.com", Template: "clinic"})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 || m.sent[0].From != "Tidepool Clinics <clinics@tidepool.org>" {
+		t.Fatalf(`Expected a single email from "Tidepool Clinics <clinics@tidepool.org>", got %v`, m.sent)
+	}
+}
+
+func Test_EmailEventHandler_Handle_MarketingUnsubscribe(t *testing.T) {
+	signer, err := consumer.NewUnsubscribeSignerFromConfig(&consumer.UnsubscribeConfig{URL: "https://api.tidepool.org/v1/unsubscribe", Secret: "secret"})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	m := &fakeMailer{}
+	suppressions := consumer.NewMemorySuppressionStore()
+	handler := newTestHandlerWithParams(t, &consumer.EmailEventHandlerParams{Mailer: m, Suppressions: suppressions, Unsubscribe: signer})
+
+	ce := newTestEvent(t, events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "reminder"})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf(`Expected a single email, got %v`, len(m.sent))
+	}
+	unsubscribeURL := signer.URL("patient@example.com")
+	if m.sent[0].UnsubscribeURL != unsubscribeURL {
+		t.Errorf(`Unsubscribe url is "%s", but should be "%s"`, m.sent[0].UnsubscribeURL, unsubscribeURL)
+	}
+	if !strings.Contains(m.sent[0].Body, html.EscapeString(unsubscribeURL)) {
+		t.Errorf(`Body should contain the unsubscribe url, got %s`, m.sent[0].Body)
+	}
+
+	if err := suppressions.Add(context.Background(), consumer.Suppression{Email: "Patient@Example.com", Reason: consumer.SuppressionReasonUnsubscribed}); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	ce.SetID("other-event-id")
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf(`Expected no email to the suppressed recipient, got %v`, len(m.sent))
+	}
+
+	ce = newTestEvent(t, events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}})
+	ce.SetID("transactional-event-id")
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 2 {
+		t.Fatalf(`Expected transactional emails to be sent to unsubscribed recipients, got %v`, len(m.sent))
+	}
+}
+
+func Test_EmailEventHandler_Handle_MarketingRejectsAdditionalRecipients(t *testing.T) {
+	signer, err := consumer.NewUnsubscribeSignerFromConfig(&consumer.UnsubscribeConfig{URL: "https://api.tidepool.org/v1/unsubscribe", Secret: "secret"})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	m := &fakeMailer{}
+	deadLetters := &fakeDeadLetterProducer{}
+	handler := newTestHandlerWithParams(t, &consumer.EmailEventHandlerParams{Mailer: m, DeadLetters: deadLetters, Unsubscribe: signer})
+
+	ce := newTestEvent(t, consumer.SendEmailTemplatePayload{
+		SendEmailTemplateEvent: events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "reminder"},
+		Cc:                     []string{"caregiver@example.com"},
+	})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 0 {
+		t.Fatalf(`Expected no email with the unsubscribe url of another recipient, got %v`, len(m.sent))
+	}
+	if len(deadLetters.published) != 1 {
+		t.Fatalf(`Expected a single dead letter, got %v`, len(deadLetters.published))
+	}
+	if retryable, _ := types.ToBool(deadLetters.published[0].Extensions()[consumer.DeadLetterRetryableExtension]); retryable {
+		t.Errorf(`Dead letter should not be retryable`)
+	}
+}
+
+func Test_EmailEventHandler_Handle_SkipsSuppressedRecipients(t *testing.T) {
+	m := &fakeMailer{}
+	deadLetters := &fakeDeadLetterProducer{}
+	suppressions := consumer.NewMemorySuppressionStore()
+	handler := newTestHandlerWithParams(t, &consumer.EmailEventHandlerParams{Mailer: m, DeadLetters: deadLetters, Suppressions: suppressions})
+	for _, suppression := range []consumer.Suppression{
+		{Email: "bounced@example.com", Reason: consumer.SuppressionReasonBounce},
+		{Email: "complained@example.com", Reason: consumer.SuppressionReasonComplaint},
+	} {
+		if err := suppressions.Add(context.Background(), suppression); err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+	}
+
+	ce := newTestEvent(t, consumer.SendEmailTemplatePayload{
+		SendEmailTemplateEvent: events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}},
+		Cc:                     []string{"complained@example.com", "clinic@example.com"},
+	})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 || !slices.Equal(m.sent[0].Cc, []string{"clinic@example.com"}) {
+		t.Fatalf(`Expected a single email without the suppressed cc recipient, got %v`, m.sent)
+	}
+
+	ce = newTestEvent(t, events.SendEmailTemplateEvent{Recipient: "bounced@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}})
+	ce.SetID("bounced-event-id")
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf(`Expected no email to the bounced recipient, got %v`, len(m.sent))
+	}
+	if len(deadLetters.published) != 0 {
+		t.Fatalf(`Expected no dead letters, got %v`, len(deadLetters.published))
+	}
+
+	payload := consumer.SendEmailTemplatePayload{SendEmailTemplateEvent: events.SendEmailTemplateEvent{Recipient: "bounced@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}}}
+	if _, err := handler.SendEmailTemplate(context.Background(), payload); !errors.Is(err, consumer.ErrRecipientSuppressed) {
+		t.Fatalf(`Error is "%v", but should be "%s"`, err, consumer.ErrRecipientSuppressed)
+	}
+}
+
+func Test_EmailEventHandler_Handle_PermanentFailures(t *testing.T) {
+	tests := map[string]struct {
+		payload        interface{}
+		mailerErr      error
+		expectedReason string
+	}{
+		"unknown template": {
+			payload:        events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "missing"},
+			expectedReason: "unknown template missing",
+		},
+		"invalid recipient": {
+			payload:        events.SendEmailTemplateEvent{Recipient: "not an email", Template: "greeting"},
+			expectedReason: "invalid recipient not an email",
+		},
+		"invalid bcc recipient": {
+			payload: consumer.SendEmailTemplatePayload{
+				SendEmailTemplateEvent: events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}},
+				Bcc:                    []string{"not an email"},
+			},
+			expectedReason: "invalid recipient not an email",
+		},
+		"invalid headers": {
+			payload: consumer.SendEmailTemplatePayload{
+				SendEmailTemplateEvent: events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}},
+				Headers:                map[string]string{"X-Tidepool-Trace": "abc\r\nBcc: attacker@example.com"},
+			},
+			expectedReason: "invalid headers",
+		},
+		"sender not allowed": {
+			payload:        events.SendEmailTemplateEvent{Recipient: "clinician@example.com", Template: "clinic"},
+			expectedReason: "sender is not allowed",
+		},
+		"rejected by backend": {
+			payload:        events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}},
+			mailerErr:      &mailer.BackendError{Backend: "ses", Code: "MessageRejected", Permanent: true, Err: errors.New("rejected")},
+			expectedReason: "ses backend error (MessageRejected): rejected",
+		},
+		"missing variables": {
+			payload:        events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting"},
+			expectedReason: "missing required variables of template greeting: Name",
+		},
+		"invalid attachment": {
+			payload: events.SendEmailTemplateEvent{
+				Recipient:   "patient@example.com",
+				Template:    "greeting",
+				Variables:   map[string]string{"Name": "Jo"},
+				Attachments: []events.EmailAttachment{{ContentType: "application/pdf", Data: "not base64!", Filename: "report.pdf"}},
+			},
+			expectedReason: "invalid attachment report.pdf",
+		},
+		"attachment reference without fetcher": {
+			payload: consumer.SendEmailTemplatePayload{
+				SendEmailTemplateEvent: events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}},
+				Attachments: []consumer.EmailAttachment{
+					{EmailAttachment: events.EmailAttachment{ContentType: "application/pdf", Filename: "report.pdf"}, Reference: "s3://reports/report.pdf"},
+				},
+			},
+			expectedReason: "invalid attachment reference",
+		},
+		"attachment too large": {
+			payload: events.SendEmailTemplateEvent{
+				Recipient:   "patient@example.com",
+				Template:    "greeting",
+				Variables:   map[string]string{"Name": "Jo"},
+				Attachments: []events.EmailAttachment{{ContentType: "text/plain", Data: base64.StdEncoding.EncodeToString(make([]byte, 11*1024*1024)), Filename: "notes.txt"}},
+			},
+			expectedReason: "attachment is too large",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			deadLetters := &fakeDeadLetterProducer{}
+			handler := newTestHandler(t, &fakeMailer{err: test.mailerErr}, deadLetters)
+
+			ce := newTestEvent(t, test.payload)
+			ce.SetExtension(consumer.DeadLetterAttemptsExtension, 2)
+			if err := handler.Handle(ce); err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			}
+			if len(deadLetters.published) != 1 {
+				t.Fatalf(`Expected a single dead letter, got %v`, len(deadLetters.published))
+			}
+
+			deadLetter := deadLetters.published[0]
+			if deadLetter.ID() != ce.ID() {
+				t.Errorf(`Dead letter id is "%s", but should be "%s"`, deadLetter.ID(), ce.ID())
+			}
+			reason, _ := types.ToString(deadLetter.Extensions()[consumer.DeadLetterReasonExtension])
+			if !strings.HasPrefix(reason, test.expectedReason) {
+				t.Errorf(`Dead letter reason is "%s", but should start with "%s"`, reason, test.expectedReason)
+			}
+			attempts, _ := types.ToInteger(deadLetter.Extensions()[consumer.DeadLetterAttemptsExtension])
+			if attempts != 3 {
+				t.Errorf(`Dead letter attempts is %v, but should be 3`, attempts)
+			}
+			if retryable, _ := types.ToBool(deadLetter.Extensions()[consumer.DeadLetterRetryableExtension]); retryable {
+				t.Errorf(`Dead letter should not be retryable`)
+			}
+		})
+	}
+}
+
+func Test_EmailEventHandler_Handle_TransientFailure(t *testing.T) {
+	deadLetters := &fakeDeadLetterProducer{}
+	mailerErr := &mailer.BackendError{Backend: "ses", Code: "TooManyRequestsException", Err: errors.New("rate exceeded")}
+	handler := newTestHandler(t, &fakeMailer{err: mailerErr}, deadLetters)
+
+	ce := newTestEvent(t, events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(deadLetters.published) != 1 {
+		t.Fatalf(`Expected a single dead letter, got %v`, len(deadLetters.published))
+	}
+	extensions := deadLetters.published[0].Extensions()
+	if retryable, _ := types.ToBool(extensions[consumer.DeadLetterRetryableExtension]); !retryable {
+		t.Errorf(`Dead letter should be retryable`)
+	}
+	if reason, _ := types.ToString(extensions[consumer.DeadLetterReasonExtension]); reason != mailerErr.Error() {
+		t.Errorf(`Dead letter reason is "%s", but should be "%s"`, reason, mailerErr.Error())
+	}
+}
+
+func Test_EmailEventHandler_Handle_RecordsMailerAttempts(t *testing.T) {
+	deadLetters := &fakeDeadLetterProducer{}
+	mailerErr := &mailer.AttemptsError{
+		Attempts: 4,
+		Err:      &mailer.BackendError{Backend: "ses", Code: "TooManyRequestsException", Err: errors.New("rate exceeded")},
+	}
+	handler := newTestHandler(t, &fakeMailer{err: mailerErr}, deadLetters)
+
+	ce := newTestEvent(t, events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}})
+	ce.SetExtension(consumer.DeadLetterAttemptsExtension, 2)
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(deadLetters.published) != 1 {
+		t.Fatalf(`Expected a single dead letter, got %v`, len(deadLetters.published))
+	}
+	attempts, _ := types.ToInteger(deadLetters.published[0].Extensions()[consumer.DeadLetterAttemptsExtension])
+	if attempts != 6 {
+		t.Errorf(`Dead letter attempts is %v, but should be 6`, attempts)
+	}
+}
+
+func Test_EmailEventHandler_Handle_DeadLetterFailure(t *testing.T) {
+	publishErr := errors.New("broker unavailable")
+	handler := newTestHandler(t, &fakeMailer{}, &fakeDeadLetterProducer{err: publishErr})
+
+	ce := newTestEvent(t, events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "missing"})
+	if err := handler.Handle(ce); !errors.Is(err, publishErr) {
+		t.Fatalf(`Error is "%v", but should be "%s"`, err, publishErr)
+	}
+}
+
+func Test_EmailEventHandler_Handle_WithoutDeadLetters(t *testing.T) {
+	mailerErr := &mailer.BackendError{Backend: "ses", Code: "TooManyRequestsException", Err: errors.New("rate exceeded")}
+	handler := newTestHandler(t, &fakeMailer{err: mailerErr}, nil)
+
+	// Returning the error would make the consumer publish the event to the disabled dead letters topic
+	ce := newTestEvent(t, events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+}
+
+func Test_EmailEventHandler_Handle_SkipsDuplicates(t *testing.T) {
+	m := &fakeMailer{}
+	handler := newTestHandler(t, m, &fakeDeadLetterProducer{})
+
+	payload := events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}}
+	redelivered := newTestEvent(t, payload)
+	for i := 0; i < 2; i++ {
+		if err := handler.Handle(redelivered); err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf(`Expected a single email, got %v`, len(m.sent))
+	}
+
+	other := newTestEvent(t, payload)
+	other.SetID("other-event-id")
+	if err := handler.Handle(other); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 2 {
+		t.Fatalf(`Expected 2 emails, got %v`, len(m.sent))
+	}
+
+	payload.Variables = map[string]string{"Name": "Jo", consumer.IdempotencyKeyVariable: "invitation-123"}
+	for _, id := range []string{"first-id", "second-id"} {
+		ce := newTestEvent(t, payload)
+		ce.SetID(id)
+		if err := handler.Handle(ce); err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+	}
+	if len(m.sent) != 3 {
+		t.Fatalf(`Expected 3 emails, got %v`, len(m.sent))
+	}
+
+	// The same key of another producer doesn't suppress the email
+	ce := newTestEvent(t, payload)
+	ce.SetID("third-id")
+	ce.SetSource("other-producer")
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 4 {
+		t.Fatalf(`Expected 4 emails, got %v`, len(m.sent))
+	}
+}
+
+func Test_EmailEventHandler_Handle_DoesNotDeduplicateFailedSends(t *testing.T) {
+	m := &fakeMailer{err: &mailer.BackendError{Backend: "ses", Code: "TooManyRequestsException", Err: errors.New("rate exceeded")}}
+	deadLetters := &fakeDeadLetterProducer{}
+	handler := newTestHandler(t, m, deadLetters)
+
+	ce := newTestEvent(t, events.SendEmailTemplateEvent{Recipient: "patient@example.com", Template: "greeting", Variables: map[string]string{"Name": "Jo"}})
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(deadLetters.published) != 1 {
+		t.Fatalf(`Expected a single dead letter, got %v`, len(deadLetters.published))
+	}
+
+	// The replayed dead letter is sent
+
+	m.err = nil
+	if err := handler.Handle(ce); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(m.sent) != 1 {
+		t.Fatalf(`Expected a single email, got %v`, len(m.sent))
+	}
+}
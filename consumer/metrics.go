@@ -0,0 +1,104 @@
+package consumer
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	failedEventsCounter         = createFailedEventsCounter()
+	duplicateEventsCounter      = createDuplicateEventsCounter()
+	missingVariablesCounter     = createMissingVariablesCounter()
+	suppressedRecipientsCounter = createSuppressedRecipientsCounter()
+	suppressedSendsCounter      = createSuppressedSendsCounter()
+)
+
+func createFailedEventsCounter() *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "failed_events",
+		},
+		[]string{"reason", "permanent"},
+	)
+
+	prometheus.MustRegister(counter)
+	return counter
+}
+
+func createDuplicateEventsCounter() prometheus.Counter {
+	counter := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "duplicate_events",
+		},
+	)
+
+	prometheus.MustRegister(counter)
+	return counter
+}
+
+func createMissingVariablesCounter() *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "missing_variables",
+		},
+		[]string{"template"},
+	)
+
+	prometheus.MustRegister(counter)
+	return counter
+}
+
+func createSuppressedRecipientsCounter() *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "suppressed_recipients",
+		},
+		[]string{"template", "reason"},
+	)
+
+	prometheus.MustRegister(counter)
+	return counter
+}
+
+func createSuppressedSendsCounter() *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "suppressed_sends",
+		},
+		[]string{"template"},
+	)
+
+	prometheus.MustRegister(counter)
+	return counter
+}
+
+func ObserveFailedEvent(reason string, permanent bool) {
+	failedEventsCounter.WithLabelValues(reason, strconv.FormatBool(permanent)).Inc()
+}
+
+func ObserveDuplicateEvent() {
+	duplicateEventsCounter.Inc()
+}
+
+func ObserveMissingVariables(template string) {
+	missingVariablesCounter.WithLabelValues(template).Inc()
+}
+
+func ObserveSuppressedRecipient(template string, reason string) {
+	suppressedRecipientsCounter.WithLabelValues(template, reason).Inc()
+}
+
+func ObserveSuppressedSend(template string) {
+	suppressedSendsCounter.WithLabelValues(template).Inc()
+}
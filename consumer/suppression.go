@@ -0,0 +1,241 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type SuppressionReason string
+
+const (
+	// SuppressionReasonBounce is recorded when an email to the recipient bounced permanently
+	SuppressionReasonBounce SuppressionReason = "bounce"
+	// SuppressionReasonComplaint is recorded when the recipient marked an email as spam
+	SuppressionReasonComplaint SuppressionReason = "complaint"
+	// SuppressionReasonManual is recorded when the recipient is suppressed by an administrator
+	SuppressionReasonManual SuppressionReason = "manual"
+	// SuppressionReasonUnsubscribed is recorded when the recipient opts out of marketing emails
+	SuppressionReasonUnsubscribed SuppressionReason = "unsubscribed"
+)
+
+type Suppression struct {
+	Email       string            `json:"email"`
+	Reason      SuppressionReason `json:"reason"`
+	Description string            `json:"description,omitempty"`
+	CreatedTime time.Time         `json:"createdTime"`
+}
+
+// Applies returns true if no emails of the category can be sent to the recipient. Unsubscribed
+// recipients still receive transactional emails, all other suppressions apply to every email.
+func (s Suppression) Applies(marketing bool) bool {
+	return marketing || s.Reason != SuppressionReasonUnsubscribed
+}
+
+// SuppressionStore records the recipients which must not receive emails. Email addresses are case-insensitive.
+type SuppressionStore interface {
+	// Get returns the suppression of the email address or nil if the address isn't suppressed
+	Get(ctx context.Context, email string) (*Suppression, error)
+	// List returns all suppressions ordered by email address
+	List(ctx context.Context) ([]Suppression, error)
+	// Add records the suppression, replacing the existing suppression of the email address. An unsubscribe
+	// never replaces a bounce, complaint or manual suppression, which can only be removed with Remove.
+	Add(ctx context.Context, suppression Suppression) error
+	// Remove deletes the suppression of the email address, it's a no-op if the address isn't suppressed
+	Remove(ctx context.Context, email string) error
+}
+
+type SuppressionConfig struct {
+	// File is optional, the suppressions are only kept in memory if it's not set
+	File string `envconfig:"TIDEPOOL_MAILER_SUPPRESSION_FILE"`
+}
+
+func NewSuppressionStore() (SuppressionStore, error) {
+	cfg := &SuppressionConfig{}
+	if err := envconfig.Process("", cfg); err != nil {
+		return nil, err
+	}
+	if cfg.File != "" {
+		return NewFileSuppressionStore(cfg.File)
+	}
+	return NewMemorySuppressionStore(), nil
+}
+
+// MemorySuppressionStore keeps the suppressions in memory, they are lost when the service restarts
+type MemorySuppressionStore struct {
+	mu      sync.RWMutex
+	entries map[string]Suppression
+}
+
+var _ SuppressionStore = &MemorySuppressionStore{}
+
+func NewMemorySuppressionStore() *MemorySuppressionStore {
+	return &MemorySuppressionStore{
+		entries: make(map[string]Suppression),
+	}
+}
+
+func (m *MemorySuppressionStore) Get(ctx context.Context, email string) (*Suppression, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	suppression, ok := m.entries[normalizeEmail(email)]
+	if !ok {
+		return nil, nil
+	}
+	return &suppression, nil
+}
+
+func (m *MemorySuppressionStore) List(ctx context.Context) ([]Suppression, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.list(), nil
+}
+
+func (m *MemorySuppressionStore) Add(ctx context.Context, suppression Suppression) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.add(suppression)
+	return nil
+}
+
+func (m *MemorySuppressionStore) Remove(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, normalizeEmail(email))
+	return nil
+}
+
+func (m *MemorySuppressionStore) list() []Suppression {
+	suppressions := make([]Suppression, 0, len(m.entries))
+	for _, suppression := range m.entries {
+		suppressions = append(suppressions, suppression)
+	}
+	slices.SortFunc(suppressions, func(a, b Suppression) int {
+		return strings.Compare(a.Email, b.Email)
+	})
+	return suppressions
+}
+
+// add returns false if the suppression was not recorded, because it would weaken the existing suppression
+func (m *MemorySuppressionStore) add(suppression Suppression) bool {
+	suppression.Email = normalizeEmail(suppression.Email)
+	if existing, ok := m.entries[suppression.Email]; ok && suppression.Reason == SuppressionReasonUnsubscribed && existing.Reason != SuppressionReasonUnsubscribed {
+		return false
+	}
+	if suppression.CreatedTime.IsZero() {
+		suppression.CreatedTime = time.Now().UTC()
+	}
+	m.entries[suppression.Email] = suppression
+	return true
+}
+
+// FileSuppressionStore keeps the suppressions in memory and persists them to a JSON file after every change
+type FileSuppressionStore struct {
+	MemorySuppressionStore
+	path string
+}
+
+var _ SuppressionStore = &FileSuppressionStore{}
+
+// NewFileSuppressionStore loads the suppressions from the file. The file is created on the first change if it doesn't exist.
+func NewFileSuppressionStore(path string) (*FileSuppressionStore, error) {
+	store := &FileSuppressionStore{
+		MemorySuppressionStore: MemorySuppressionStore{entries: make(map[string]Suppression)},
+		path:                   path,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var suppressions []Suppression
+	if err := json.Unmarshal(data, &suppressions); err != nil {
+		return nil, err
+	}
+	for _, suppression := range suppressions {
+		store.add(suppression)
+	}
+	return store, nil
+}
+
+func (f *FileSuppressionStore) Add(ctx context.Context, suppression Suppression) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := normalizeEmail(suppression.Email)
+	previous, existed := f.entries[key]
+	if !f.add(suppression) {
+		return nil
+	}
+	if err := f.save(); err != nil {
+		f.restore(key, previous, existed)
+		return err
+	}
+	return nil
+}
+
+func (f *FileSuppressionStore) Remove(ctx context.Context, email string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := normalizeEmail(email)
+	previous, existed := f.entries[key]
+	delete(f.entries, key)
+	if err := f.save(); err != nil {
+		f.restore(key, previous, existed)
+		return err
+	}
+	return nil
+}
+
+// restore reverts a change which couldn't be persisted
+func (f *FileSuppressionStore) restore(key string, previous Suppression, existed bool) {
+	if existed {
+		f.entries[key] = previous
+	} else {
+		delete(f.entries, key)
+	}
+}
+
+// save atomically replaces the file, so it's never left partially written
+func (f *FileSuppressionStore) save() error {
+	data, err := json.MarshalIndent(f.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,98 @@
+package consumer_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/tidepool-org/mailer/consumer"
+)
+
+func Test_FileSuppressionStore_Persists(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "suppressions.json")
+	store, err := consumer.NewFileSuppressionStore(path)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	for _, suppression := range []consumer.Suppression{
+		{Email: "Bounced@Example.com", Reason: consumer.SuppressionReasonBounce, Description: "mailbox does not exist"},
+		{Email: "complained@example.com", Reason: consumer.SuppressionReasonComplaint},
+	} {
+		if err := store.Add(ctx, suppression); err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+	}
+	if err := store.Remove(ctx, "complained@example.com"); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	reloaded, err := consumer.NewFileSuppressionStore(path)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	suppressions, err := reloaded.List(ctx)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(suppressions) != 1 {
+		t.Fatalf(`Expected a single suppression, got %v`, suppressions)
+	}
+	suppression := suppressions[0]
+	if suppression.Email != "bounced@example.com" || suppression.Reason != consumer.SuppressionReasonBounce || suppression.Description != "mailbox does not exist" {
+		t.Errorf(`Suppression is %v, but should be the bounced address`, suppression)
+	}
+	if suppression.CreatedTime.IsZero() {
+		t.Errorf(`Created time should be set`)
+	}
+}
+
+func Test_Suppression_Applies(t *testing.T) {
+	unsubscribed := consumer.Suppression{Reason: consumer.SuppressionReasonUnsubscribed}
+	if unsubscribed.Applies(false) || !unsubscribed.Applies(true) {
+		t.Errorf(`Unsubscribed recipients should only be suppressed for marketing emails`)
+	}
+	bounced := consumer.Suppression{Reason: consumer.SuppressionReasonBounce}
+	if !bounced.Applies(false) || !bounced.Applies(true) {
+		t.Errorf(`Bounced recipients should be suppressed for all emails`)
+	}
+}
+
+func Test_SuppressionStore_UnsubscribeKeepsStrongerSuppressions(t *testing.T) {
+	ctx := context.Background()
+	file, err := consumer.NewFileSuppressionStore(filepath.Join(t.TempDir(), "suppressions.json"))
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	stores := map[string]consumer.SuppressionStore{
+		"memory": consumer.NewMemorySuppressionStore(),
+		"file":   file,
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, reason := range []consumer.SuppressionReason{consumer.SuppressionReasonBounce, consumer.SuppressionReasonComplaint, consumer.SuppressionReasonManual} {
+				email := string(reason) + "@example.com"
+				if err := store.Add(ctx, consumer.Suppression{Email: email, Reason: reason}); err != nil {
+					t.Fatalf(`Error is "%s", but should be nil`, err)
+				}
+				if err := store.Add(ctx, consumer.Suppression{Email: email, Reason: consumer.SuppressionReasonUnsubscribed}); err != nil {
+					t.Fatalf(`Error is "%s", but should be nil`, err)
+				}
+				if suppression, _ := store.Get(ctx, email); suppression == nil || suppression.Reason != reason {
+					t.Errorf(`Suppression is %v, but the reason should be %s`, suppression, reason)
+				}
+			}
+
+			if err := store.Add(ctx, consumer.Suppression{Email: "patient@example.com", Reason: consumer.SuppressionReasonUnsubscribed}); err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			}
+			if err := store.Add(ctx, consumer.Suppression{Email: "patient@example.com", Reason: consumer.SuppressionReasonBounce}); err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			}
+			if suppression, _ := store.Get(ctx, "patient@example.com"); suppression == nil || suppression.Reason != consumer.SuppressionReasonBounce {
+				t.Errorf(`Suppression is %v, but a bounce should replace the unsubscribe`, suppression)
+			}
+		})
+	}
+}
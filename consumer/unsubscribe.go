@@ -0,0 +1,95 @@
+package consumer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/kelseyhightower/envconfig"
+	"go.uber.org/zap"
+)
+
+const (
+	// UnsubscribeURLVariable is the name of the variable which holds the unsubscribe url of marketing emails
+	UnsubscribeURLVariable = "UnsubscribeURL"
+
+	UnsubscribeEmailParameter     = "email"
+	UnsubscribeSignatureParameter = "signature"
+)
+
+// UnsubscribeConfig is optional, marketing emails are sent without unsubscribe urls and headers if
+// neither the url nor the secret are set
+type UnsubscribeConfig struct {
+	// URL is the public https url of the unsubscribe endpoint
+	URL string `envconfig:"TIDEPOOL_MAILER_UNSUBSCRIBE_URL" validate:"required_with=Secret,omitempty,url,startswith=https://"`
+	// Secret is the key used to sign the unsubscribe urls
+	Secret string `envconfig:"TIDEPOOL_MAILER_UNSUBSCRIBE_SECRET" validate:"required_with=URL"`
+}
+
+// UnsubscribeSigner generates and verifies the signed unsubscribe urls of marketing emails
+type UnsubscribeSigner struct {
+	url    *url.URL
+	secret []byte
+}
+
+// NewUnsubscribeSigner returns nil if the unsubscribe url and secret are not configured
+func NewUnsubscribeSigner(validate *validator.Validate, logger *zap.SugaredLogger) (*UnsubscribeSigner, error) {
+	cfg := &UnsubscribeConfig{}
+	if err := envconfig.Process("", cfg); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.URL == "" {
+		logger.Warn("Unsubscribe url and secret are not set, marketing emails are sent without unsubscribe urls")
+		return nil, nil
+	}
+	return NewUnsubscribeSignerFromConfig(cfg)
+}
+
+func NewUnsubscribeSignerFromConfig(cfg *UnsubscribeConfig) (*UnsubscribeSigner, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("unsubscribe url must be an absolute https url")
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("unsubscribe secret is missing")
+	}
+
+	return &UnsubscribeSigner{
+		url:    u,
+		secret: []byte(cfg.Secret),
+	}, nil
+}
+
+// URL returns the signed unsubscribe url of the email address
+func (u *UnsubscribeSigner) URL(email string) string {
+	result := *u.url
+	query := result.Query()
+	query.Set(UnsubscribeEmailParameter, email)
+	query.Set(UnsubscribeSignatureParameter, base64.RawURLEncoding.EncodeToString(u.sign(email)))
+	result.RawQuery = query.Encode()
+	return result.String()
+}
+
+// Verify returns true if the signature was generated for the email address
+func (u *UnsubscribeSigner) Verify(email string, signature string) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(decoded, u.sign(email))
+}
+
+func (u *UnsubscribeSigner) sign(email string) []byte {
+	mac := hmac.New(sha256.New, u.secret)
+	mac.Write([]byte(normalizeEmail(email)))
+	return mac.Sum(nil)
+}
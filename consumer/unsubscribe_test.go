@@ -0,0 +1,47 @@
+package consumer_test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/tidepool-org/mailer/consumer"
+)
+
+func Test_NewUnsubscribeSignerFromConfig_Invalid(t *testing.T) {
+	tests := map[string]consumer.UnsubscribeConfig{
+		"http url":       {URL: "http://localhost:8080/v1/unsubscribe", Secret: "secret"},
+		"relative url":   {URL: "/v1/unsubscribe", Secret: "secret"},
+		"without secret": {URL: "https://api.tidepool.org/v1/unsubscribe"},
+	}
+
+	for name, cfg := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := consumer.NewUnsubscribeSignerFromConfig(&cfg); err == nil {
+				t.Fatal("Error should not be nil")
+			}
+		})
+	}
+}
+
+func Test_UnsubscribeSigner_Verify(t *testing.T) {
+	signer, err := consumer.NewUnsubscribeSignerFromConfig(&consumer.UnsubscribeConfig{URL: "https://api.tidepool.org/v1/unsubscribe", Secret: "secret"})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	other, err := consumer.NewUnsubscribeSignerFromConfig(&consumer.UnsubscribeConfig{URL: "https://api.tidepool.org/v1/unsubscribe", Secret: "other"})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	signed, err := url.Parse(signer.URL("patient@example.com"))
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	signature := signed.Query().Get(consumer.UnsubscribeSignatureParameter)
+	if !signer.Verify("Patient@Example.com", signature) {
+		t.Error("Signature should be valid for the normalized email address")
+	}
+	if other.Verify("patient@example.com", signature) {
+		t.Error("Signature should be invalid with a different secret")
+	}
+}
@@ -0,0 +1,175 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/kelseyhightower/envconfig"
+)
+
+const (
+	defaultAttachmentFilename = "attachment"
+	maxFilenameLength         = 255
+	// base64 encoded MIME parts are wrapped at 76 characters
+	base64LineLength = 76
+	// attachmentHeadersSize is a generous estimate of the size of the MIME part headers of an attachment
+	attachmentHeadersSize = 512
+)
+
+var (
+	ErrInvalidAttachment  = errors.New("invalid attachment")
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+)
+
+type AttachmentValidatorConfig struct {
+	// MaxAttachmentSize is the maximum decoded size of a single attachment in bytes
+	MaxAttachmentSize int `envconfig:"TIDEPOOL_MAILER_MAX_ATTACHMENT_SIZE" default:"10485760" validate:"min=1"`
+	// MaxMessageSize is the maximum estimated size of the raw message in bytes, i.e. the bodies and the
+	// base64 encoded attachments. It can't exceed 40 MB, which is the maximum message size of SES.
+	MaxMessageSize int `envconfig:"TIDEPOOL_MAILER_MAX_MESSAGE_SIZE" default:"40000000" validate:"min=1,max=40000000"`
+}
+
+// AttachmentValidator decodes and validates the attachments of an email before it's sent, so invalid
+// attachments are rejected with a permanent error instead of failing while the message is encoded
+type AttachmentValidator struct {
+	cfg *AttachmentValidatorConfig
+}
+
+func NewAttachmentValidator(validate *validator.Validate) (*AttachmentValidator, error) {
+	cfg := &AttachmentValidatorConfig{}
+	if err := envconfig.Process("", cfg); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(cfg); err != nil {
+		return nil, err
+	}
+	return NewAttachmentValidatorFromConfig(cfg), nil
+}
+
+func NewAttachmentValidatorFromConfig(cfg *AttachmentValidatorConfig) *AttachmentValidator {
+	return &AttachmentValidator{cfg: cfg}
+}
+
+// Validate checks the base64 encoding, the size and the content type of the attachments. The filenames
+// are sanitized, the content types are normalized and the data is re-encoded in place.
+func (a *AttachmentValidator) Validate(email *Email) error {
+	size := len(email.Body) + len(email.TextBody)
+	for i, attachment := range email.Attachments {
+		filename := SanitizeFilename(attachment.Filename)
+
+		data, err := decodeAttachmentData(attachment.Data)
+		if err != nil {
+			return fmt.Errorf("%w %s: %w", ErrInvalidAttachment, filename, err)
+		}
+		if len(data) > a.cfg.MaxAttachmentSize {
+			return fmt.Errorf("%w: %s has %d bytes, the limit is %d bytes", ErrAttachmentTooLarge, filename, len(data), a.cfg.MaxAttachmentSize)
+		}
+
+		mediaType, params, err := mime.ParseMediaType(attachment.ContentType)
+		if err != nil {
+			return fmt.Errorf("%w %s: content type %q: %w", ErrInvalidAttachment, filename, attachment.ContentType, err)
+		}
+		sniffed := http.DetectContentType(data)
+		if !compatibleContentType(mediaType, sniffed) {
+			return fmt.Errorf("%w %s: content type is %s, but the content is %s", ErrInvalidAttachment, filename, mediaType, sniffed)
+		}
+
+		size += encodedAttachmentSize(len(data))
+		if size > a.cfg.MaxMessageSize {
+			return fmt.Errorf("%w: the message exceeds %d bytes", ErrAttachmentTooLarge, a.cfg.MaxMessageSize)
+		}
+
+		email.Attachments[i].Filename = filename
+		email.Attachments[i].ContentType = mime.FormatMediaType(mediaType, params)
+		email.Attachments[i].Data = base64.StdEncoding.EncodeToString(data)
+	}
+	return nil
+}
+
+// decodeAttachmentData decodes padded standard base64, which can be wrapped into lines
+func decodeAttachmentData(data string) ([]byte, error) {
+	data = strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, data)
+	return base64.StdEncoding.DecodeString(data)
+}
+
+func encodedAttachmentSize(size int) int {
+	encoded := base64.StdEncoding.EncodedLen(size)
+	lines := (encoded + base64LineLength - 1) / base64LineLength
+	return attachmentHeadersSize + encoded + 2*lines
+}
+
+// compatibleContentType returns true if the sniffed content type doesn't contradict the declared media
+// type. Content which can't be identified is accepted, because most document formats aren't sniffed.
+func compatibleContentType(mediaType string, sniffed string) bool {
+	sniffedType, _, _ := mime.ParseMediaType(sniffed)
+	if mediaType == "image/jpg" {
+		mediaType = "image/jpeg"
+	}
+
+	switch {
+	case mediaType == sniffedType, mediaType == "application/octet-stream", sniffedType == "application/octet-stream":
+		return true
+	case sniffedType == "text/plain":
+		return strings.HasPrefix(mediaType, "text/") || isStructuredText(mediaType)
+	case sniffedType == "text/xml":
+		return mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml")
+	case sniffedType == "application/zip":
+		// Office documents, OpenDocument files and other containers are zip archives
+		return strings.Contains(mediaType, "zip") ||
+			strings.HasPrefix(mediaType, "application/vnd.openxmlformats-officedocument.") ||
+			strings.HasPrefix(mediaType, "application/vnd.oasis.opendocument.") ||
+			mediaType == "application/java-archive"
+	default:
+		return false
+	}
+}
+
+func isStructuredText(mediaType string) bool {
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-ndjson":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// SanitizeFilename strips directories, control characters and characters which aren't allowed by
+// common file systems from the filename of an attachment, and truncates it to 255 bytes
+func SanitizeFilename(filename string) string {
+	filename = path.Base(strings.ReplaceAll(filename, `\`, "/"))
+	filename = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, filename)
+	filename = strings.Trim(filename, " .")
+	if filename == "" {
+		return defaultAttachmentFilename
+	}
+
+	if len(filename) > maxFilenameLength {
+		ext := path.Ext(filename)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		base := strings.TrimSuffix(filename, ext)
+		for len(base)+len(ext) > maxFilenameLength {
+			_, size := utf8.DecodeLastRuneInString(base)
+			base = base[:len(base)-size]
+		}
+		filename = base + ext
+	}
+	return filename
+}
@@ -0,0 +1,114 @@
+package mailer_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tidepool-org/mailer/mailer"
+)
+
+var pdf = []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+
+func newTestAttachmentValidator() *mailer.AttachmentValidator {
+	return mailer.NewAttachmentValidatorFromConfig(&mailer.AttachmentValidatorConfig{
+		MaxAttachmentSize: 1024,
+		MaxMessageSize:    4096,
+	})
+}
+
+func Test_AttachmentValidator_Validate_Success(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(pdf)
+	email := &mailer.Email{
+		Body: "<p>Report</p>",
+		Attachments: []mailer.Attachment{
+			{ContentType: "Application/PDF", Data: encoded[:20] + "\r\n" + encoded[20:], Filename: `C:\reports\..\report:1.pdf`},
+			{ContentType: "text/csv; charset=utf-8", Data: "YSxiCg==", Filename: "data.csv"},
+		},
+	}
+
+	if err := newTestAttachmentValidator().Validate(email); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	attachment := email.Attachments[0]
+	if attachment.Filename != "report_1.pdf" {
+		t.Errorf(`Filename is "%s", but should be "report_1.pdf"`, attachment.Filename)
+	}
+	if attachment.ContentType != "application/pdf" {
+		t.Errorf(`Content type is "%s", but should be "application/pdf"`, attachment.ContentType)
+	}
+	if attachment.Data != encoded {
+		t.Errorf(`Data is "%s", but should be "%s"`, attachment.Data, encoded)
+	}
+	if email.Attachments[1].ContentType != "text/csv; charset=utf-8" {
+		t.Errorf(`Content type is "%s", but should be "text/csv; charset=utf-8"`, email.Attachments[1].ContentType)
+	}
+}
+
+func Test_AttachmentValidator_Validate_Invalid(t *testing.T) {
+	large := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 1000)))
+	tests := map[string]struct {
+		attachments []mailer.Attachment
+		expectedErr error
+	}{
+		"invalid base64": {
+			attachments: []mailer.Attachment{{ContentType: "application/pdf", Data: "not base64!", Filename: "report.pdf"}},
+			expectedErr: mailer.ErrInvalidAttachment,
+		},
+		"invalid content type": {
+			attachments: []mailer.Attachment{{ContentType: "pdf", Data: base64.StdEncoding.EncodeToString(pdf), Filename: "report.pdf"}},
+			expectedErr: mailer.ErrInvalidAttachment,
+		},
+		"mismatched content type": {
+			attachments: []mailer.Attachment{{ContentType: "image/png", Data: base64.StdEncoding.EncodeToString(pdf), Filename: "logo.png"}},
+			expectedErr: mailer.ErrInvalidAttachment,
+		},
+		"html declared as text": {
+			attachments: []mailer.Attachment{{ContentType: "text/plain", Data: base64.StdEncoding.EncodeToString([]byte("<html><script></script></html>")), Filename: "notes.txt"}},
+			expectedErr: mailer.ErrInvalidAttachment,
+		},
+		"attachment too large": {
+			attachments: []mailer.Attachment{{ContentType: "text/plain", Data: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 1025))), Filename: "notes.txt"}},
+			expectedErr: mailer.ErrAttachmentTooLarge,
+		},
+		"message too large": {
+			attachments: []mailer.Attachment{
+				{ContentType: "text/plain", Data: large, Filename: "a.txt"},
+				{ContentType: "text/plain", Data: large, Filename: "b.txt"},
+				{ContentType: "text/plain", Data: large, Filename: "c.txt"},
+			},
+			expectedErr: mailer.ErrAttachmentTooLarge,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := newTestAttachmentValidator().Validate(&mailer.Email{Attachments: test.attachments})
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf(`Error is "%v", but should be "%s"`, err, test.expectedErr)
+			}
+		})
+	}
+}
+
+func Test_SanitizeFilename(t *testing.T) {
+	tests := map[string]string{
+		"report.pdf":                       "report.pdf",
+		"../../etc/passwd":                 "passwd",
+		`C:\Users\patient\report.pdf`:      "report.pdf",
+		"report\r\nBcc: x@example.com.pdf": "report__Bcc_ x@example.com.pdf",
+		`"quoted" <name>?.pdf`:             "_quoted_ _name__.pdf",
+		" .hidden. ":                       "hidden",
+		"":                                 "attachment",
+		"..":                               "attachment",
+		"résumé.pdf":                       "résumé.pdf",
+		strings.Repeat("é", 200) + ".pdf":  strings.Repeat("é", 125) + ".pdf",
+	}
+
+	for filename, expected := range tests {
+		if sanitized := mailer.SanitizeFilename(filename); sanitized != expected {
+			t.Errorf(`Sanitized filename of "%s" is "%s", but should be "%s"`, filename, sanitized, expected)
+		}
+	}
+}
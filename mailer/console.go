@@ -20,7 +20,7 @@ func NewConsoleMailer(logger *zap.SugaredLogger) *ConsoleMailer {
 	return &ConsoleMailer{logger: logger}
 }
 
-func (c *ConsoleMailer) Send(ctx context.Context, email *Email) error {
+func (c *ConsoleMailer) Send(ctx context.Context, email *Email) (string, error) {
 	c.logger.Infow("Received new email message", "email", email)
-	return nil
+	return "", nil
 }
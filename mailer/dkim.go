@@ -0,0 +1,221 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrInvalidDKIMKey = errors.New("invalid dkim private key")
+
+// dkimSignedHeaders are signed if they are present in the message. From is always present.
+var dkimSignedHeaders = []string{
+	"From",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"To",
+	"Cc",
+	"Message-ID",
+	"MIME-Version",
+	"Content-Type",
+	"List-Unsubscribe",
+	"List-Unsubscribe-Post",
+}
+
+type DKIMConfig struct {
+	// Domain is optional, messages are signed only if it's set
+	Domain   string `envconfig:"TIDEPOOL_DKIM_DOMAIN" validate:"omitempty,fqdn"`
+	Selector string `envconfig:"TIDEPOOL_DKIM_SELECTOR" validate:"required_with=Domain"`
+	// PrivateKey is the PEM encoded RSA or Ed25519 key, it takes precedence over PrivateKeyFile
+	PrivateKey     string `envconfig:"TIDEPOOL_DKIM_PRIVATE_KEY"`
+	PrivateKeyFile string `envconfig:"TIDEPOOL_DKIM_PRIVATE_KEY_FILE"`
+}
+
+// DKIMSigner adds a relaxed/relaxed DKIM-Signature header to raw messages
+type DKIMSigner struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+	now       func() time.Time
+}
+
+// NewDKIMSigner returns nil if the domain is not configured
+func NewDKIMSigner(cfg *DKIMConfig) (*DKIMSigner, error) {
+	if cfg.Domain == "" {
+		return nil, nil
+	}
+
+	data := []byte(cfg.PrivateKey)
+	if cfg.PrivateKey == "" {
+		if cfg.PrivateKeyFile == "" {
+			return nil, fmt.Errorf("%w: private key is required to sign messages for %s", ErrInvalidDKIMKey, cfg.Domain)
+		}
+		var err error
+		if data, err = os.ReadFile(cfg.PrivateKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	key, err := parseDKIMKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := &DKIMSigner{
+		domain:   cfg.Domain,
+		selector: cfg.Selector,
+		key:      key,
+		now:      time.Now,
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		signer.algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		signer.algorithm = "ed25519-sha256"
+	}
+	return signer, nil
+}
+
+func parseDKIMKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: key is not pem encoded", ErrInvalidDKIMKey)
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidDKIMKey, err)
+		}
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidDKIMKey, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", ErrInvalidDKIMKey, key)
+	}
+}
+
+// Sign returns the message with the DKIM-Signature header prepended
+func (d *DKIMSigner) Sign(data []byte) ([]byte, error) {
+	headers, body, ok := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("unable to sign message without body")
+	}
+	fields := splitHeaderFields(headers)
+
+	bodyHash := sha256.Sum256(canonicalizeBodyRelaxed(body))
+	hash := sha256.New()
+	var signed []string
+	used := make(map[int]bool)
+	for _, name := range dkimSignedHeaders {
+		// Multiple instances of a header are signed from the bottom up
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headerFieldName(fields[i]), name) {
+				used[i] = true
+				hash.Write([]byte(canonicalizeHeaderRelaxed(fields[i])))
+				signed = append(signed, name)
+				break
+			}
+		}
+	}
+	if len(signed) == 0 || signed[0] != "From" {
+		return nil, errors.New("unable to sign message without from header")
+	}
+
+	value := strings.Join([]string{
+		"v=1",
+		"a=" + d.algorithm,
+		"c=relaxed/relaxed",
+		"d=" + d.domain,
+		"s=" + d.selector,
+		fmt.Sprintf("t=%d", d.now().Unix()),
+		"h=" + strings.Join(signed, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}, "; ")
+	hash.Write([]byte(strings.TrimSuffix(canonicalizeHeaderRelaxed("DKIM-Signature: "+value), "\r\n")))
+
+	var signature []byte
+	var err error
+	if key, ok := d.key.(ed25519.PrivateKey); ok {
+		// Ed25519 signs the hash of the canonicalized headers (RFC 8463)
+		signature = ed25519.Sign(key, hash.Sum(nil))
+	} else {
+		signature, err = d.key.Sign(rand.Reader, hash.Sum(nil), crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign message: %w", err)
+	}
+
+	header := "DKIM-Signature: " + strings.ReplaceAll(value, "; ", ";\r\n\t") + base64.StdEncoding.EncodeToString(signature) + "\r\n"
+	return append([]byte(header), data...), nil
+}
+
+// splitHeaderFields returns the header fields including their continuation lines
+func splitHeaderFields(headers []byte) []string {
+	var fields []string
+	for _, line := range strings.Split(string(headers), "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += "\r\n" + line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	return fields
+}
+
+func headerFieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimRight(name, " \t")
+}
+
+// canonicalizeHeaderRelaxed implements the relaxed header canonicalization of RFC 6376 section 3.4.2
+func canonicalizeHeaderRelaxed(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value + "\r\n"
+}
+
+// canonicalizeBodyRelaxed implements the relaxed body canonicalization of RFC 6376 section 3.4.4
+func canonicalizeBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		collapsed := strings.Join(strings.FieldsFunc(line, isWSP), " ")
+		if len(line) > 0 && isWSP(rune(line[0])) && collapsed != "" {
+			collapsed = " " + collapsed
+		}
+		lines[i] = collapsed
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
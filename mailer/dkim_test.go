@@ -0,0 +1,167 @@
+package mailer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+var whitespace = regexp.MustCompile(`[ \t]+`)
+
+// verifyDKIM verifies the relaxed/relaxed DKIM signature of the message independently of the signer
+func verifyDKIM(message []byte, publicKey crypto.PublicKey) error {
+	headers, body, _ := bytes.Cut(message, []byte("\r\n\r\n"))
+	var fields [][2]string
+	for _, line := range strings.Split(string(headers), "\r\n") {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			fields[len(fields)-1][1] += "\r\n" + line
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		fields = append(fields, [2]string{name, value})
+	}
+	relaxed := func(field [2]string) string {
+		value := whitespace.ReplaceAllString(strings.ReplaceAll(field[1], "\r\n", ""), " ")
+		return strings.ToLower(strings.TrimSpace(field[0])) + ":" + strings.TrimSpace(value) + "\r\n"
+	}
+
+	if !strings.EqualFold(fields[0][0], "DKIM-Signature") {
+		return errors.New("missing signature")
+	}
+	signatureField := fields[0]
+	tags := map[string]string{}
+	for _, tag := range strings.Split(whitespace.ReplaceAllString(strings.ReplaceAll(signatureField[1], "\r\n", ""), ""), ";") {
+		name, value, _ := strings.Cut(tag, "=")
+		tags[name] = value
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(body), "\r\n") {
+		lines = append(lines, strings.TrimRight(whitespace.ReplaceAllString(line, " "), " "))
+	}
+	canonicalBody := strings.TrimRight(strings.Join(lines, "\r\n"), "\r\n") + "\r\n"
+	bodyHash := sha256.Sum256([]byte(canonicalBody))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	hash := sha256.New()
+	used := map[int]bool{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i > 0; i-- {
+			if !used[i] && strings.EqualFold(strings.TrimSpace(fields[i][0]), name) {
+				used[i] = true
+				hash.Write([]byte(relaxed(fields[i])))
+				break
+			}
+		}
+	}
+	unsigned := regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(signatureField[1], "b=")
+	hash.Write([]byte(strings.TrimSuffix(relaxed([2]string{signatureField[0], unsigned}), "\r\n")))
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return fmt.Errorf("unexpected algorithm %s", tags["a"])
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash.Sum(nil), signature)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" || !ed25519.Verify(key, hash.Sum(nil), signature) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key")
+}
+
+func newTestDKIMKey(t *testing.T, algorithm string) (string, crypto.PublicKey) {
+	switch algorithm {
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})), &key.PublicKey
+	default:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), public
+	}
+}
+
+func Test_DKIMSigner_Sign(t *testing.T) {
+	for _, algorithm := range []string{"rsa", "ed25519"} {
+		t.Run(algorithm, func(t *testing.T) {
+			privateKey, publicKey := newTestDKIMKey(t, algorithm)
+			signer, err := mailer.NewDKIMSigner(&mailer.DKIMConfig{Domain: "tidepool.org", Selector: "mailer", PrivateKey: privateKey})
+			if err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			}
+			m := mailer.NewMemoryMailer(&mailer.MemoryMailerParams{
+				Cfg:    &mailer.MemoryMailerConfig{SenderName: "Tidepool", SenderAddress: "noreply@tidepool.org", Capacity: 1},
+				DKIM:   signer,
+				Logger: zap.NewNop().Sugar(),
+			})
+
+			id, err := m.Send(context.Background(), &mailer.Email{
+				Recipients:     []string{"patient@example.com"},
+				Subject:        "Your   data\tis ready",
+				Body:           "<p>Hello  \t world</p>  \r\n\r\n",
+				TextBody:       "Hello world",
+				UnsubscribeURL: "https://tidepool.org/unsubscribe",
+			})
+			if err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			}
+			raw := m.Get(id).Raw
+			if !bytes.HasPrefix(raw, []byte("DKIM-Signature: v=1;")) || !bytes.Contains(raw, []byte("d=tidepool.org;")) || !bytes.Contains(raw, []byte("s=mailer;")) {
+				t.Fatalf(`Message should start with the dkim signature, got %s`, raw)
+			}
+			if err := verifyDKIM(raw, publicKey); err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			}
+
+			tampered := bytes.Replace(raw, []byte("Your   data"), []byte("Our data"), 1)
+			if err := verifyDKIM(tampered, publicKey); err == nil {
+				t.Fatal("Signature of the tampered message should be invalid")
+			}
+		})
+	}
+}
+
+func Test_NewDKIMSigner(t *testing.T) {
+	if signer, err := mailer.NewDKIMSigner(&mailer.DKIMConfig{}); err != nil || signer != nil {
+		t.Fatalf(`Expected no signer, got %v and "%v"`, signer, err)
+	}
+	if _, err := mailer.NewDKIMSigner(&mailer.DKIMConfig{Domain: "tidepool.org", Selector: "mailer"}); !errors.Is(err, mailer.ErrInvalidDKIMKey) {
+		t.Fatalf(`Error is "%v", but should be "%s"`, err, mailer.ErrInvalidDKIMKey)
+	}
+	if _, err := mailer.NewDKIMSigner(&mailer.DKIMConfig{Domain: "tidepool.org", Selector: "mailer", PrivateKey: "invalid"}); !errors.Is(err, mailer.ErrInvalidDKIMKey) {
+		t.Fatalf(`Error is "%v", but should be "%s"`, err, mailer.ErrInvalidDKIMKey)
+	}
+}
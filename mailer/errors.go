@@ -0,0 +1,74 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BackendError is returned when a backend fails to deliver a message
+type BackendError struct {
+	Backend string
+	Code    string
+	// Permanent is set when the backend rejected the message and sending it again won't succeed
+	Permanent bool
+	Err       error
+}
+
+func (b *BackendError) Error() string {
+	return fmt.Sprintf("%s backend error (%s): %s", b.Backend, b.Code, b.Err)
+}
+
+func (b *BackendError) Unwrap() error {
+	return b.Err
+}
+
+// PermanentError wraps failures which won't succeed if the same email is sent again
+type PermanentError struct {
+	Err error
+}
+
+func NewPermanentError(err error) error {
+	return &PermanentError{Err: err}
+}
+
+func (p *PermanentError) Error() string {
+	return p.Err.Error()
+}
+
+func (p *PermanentError) Unwrap() error {
+	return p.Err
+}
+
+// IsPermanent returns true if err or any error it wraps is a permanent failure
+func IsPermanent(err error) bool {
+	var permanentErr *PermanentError
+	if errors.As(err, &permanentErr) {
+		return true
+	}
+	var backendErr *BackendError
+	return errors.As(err, &backendErr) && backendErr.Permanent
+}
+
+// AttemptsError records how many times the email was sent before the error was returned
+type AttemptsError struct {
+	Attempts int
+	Err      error
+}
+
+func (a *AttemptsError) Error() string {
+	return a.Err.Error()
+}
+
+func (a *AttemptsError) Unwrap() error {
+	return a.Err
+}
+
+// Attempts returns the number of times the email was sent before err was returned, which is 1 unless
+// the error was returned by the retrying or the failover mailer
+func Attempts(err error) int {
+	var attemptsErr *AttemptsError
+	if errors.As(err, &attemptsErr) {
+		return attemptsErr.Attempts
+	}
+	return 1
+}
@@ -0,0 +1,187 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrNoBackendAvailable = errors.New("no mailer backend available")
+
+type FailoverConfig struct {
+	// BreakerThreshold is the number of consecutive transient failures which open the circuit breaker of a backend
+	BreakerThreshold int `envconfig:"TIDEPOOL_MAILER_BREAKER_THRESHOLD" default:"5" validate:"min=1"`
+	// BreakerCooldown is the time after which a single email is sent to a backend with an open circuit breaker
+	BreakerCooldown time.Duration `envconfig:"TIDEPOOL_MAILER_BREAKER_COOLDOWN" default:"30s" validate:"min=0"`
+}
+
+// FailoverBackend is a named backend of the failover chain, e.g. "ses:us-east-1"
+type FailoverBackend struct {
+	Name   string
+	Mailer Mailer
+}
+
+// FailoverMailer sends the email with the first backend of the chain which doesn't fail with a transient
+// error. Backends with an open circuit breaker are skipped until the cooldown has passed. Permanent errors
+// are returned immediately, because the other backends would reject the email too.
+type FailoverMailer struct {
+	backends []*failoverBackend
+	logger   *zap.SugaredLogger
+}
+
+// Compile time interface check
+var _ Mailer = &FailoverMailer{}
+
+type FailoverMailerParams struct {
+	Backends []FailoverBackend
+	Cfg      *FailoverConfig
+	Logger   *zap.SugaredLogger
+}
+
+type failoverBackend struct {
+	FailoverBackend
+	breaker *circuitBreaker
+}
+
+func NewFailoverMailer(params *FailoverMailerParams) *FailoverMailer {
+	backends := make([]*failoverBackend, len(params.Backends))
+	for i, backend := range params.Backends {
+		backends[i] = &failoverBackend{
+			FailoverBackend: backend,
+			breaker: &circuitBreaker{
+				threshold: params.Cfg.BreakerThreshold,
+				cooldown:  params.Cfg.BreakerCooldown,
+				now:       time.Now,
+			},
+		}
+		ObserveCircuitBreaker(backend.Name, false)
+	}
+	return &FailoverMailer{
+		backends: backends,
+		logger:   params.Logger,
+	}
+}
+
+func (f *FailoverMailer) Send(ctx context.Context, email *Email) (string, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var lastErr error
+	attempts := 0
+	for i, backend := range f.backends {
+		if !backend.breaker.allow() {
+			f.logger.Debugw("Skipping backend with open circuit breaker", "backend", backend.Name)
+			continue
+		}
+
+		id, err := backend.Mailer.Send(ctx, email)
+		if err != nil {
+			attempts += Attempts(err)
+		}
+		if err == nil || IsPermanent(err) {
+			// The backend is healthy even if it rejected the email
+			f.recordSuccess(backend)
+		}
+		if err == nil {
+			ObserveDelivery(backend.Name)
+			f.logger.Infow("Delivered email", "backend", backend.Name, "id", id)
+			return id, nil
+		} else if IsPermanent(err) {
+			return "", &AttemptsError{Attempts: attempts, Err: err}
+		} else if ctx.Err() != nil {
+			backend.breaker.release()
+			return "", &AttemptsError{Attempts: attempts, Err: err}
+		}
+
+		f.recordFailure(backend)
+		lastErr = err
+		if i < len(f.backends)-1 {
+			ObserveFailover(backend.Name)
+			f.logger.Warnw("Failing over to the next backend after transient error", "backend", backend.Name, "error", err)
+		}
+	}
+
+	if lastErr == nil {
+		return "", ErrNoBackendAvailable
+	}
+	return "", &AttemptsError{Attempts: attempts, Err: fmt.Errorf("%w: %w", ErrNoBackendAvailable, lastErr)}
+}
+
+func (f *FailoverMailer) recordSuccess(backend *failoverBackend) {
+	if backend.breaker.success() {
+		ObserveCircuitBreaker(backend.Name, false)
+		f.logger.Infow("Closed circuit breaker", "backend", backend.Name)
+	}
+}
+
+func (f *FailoverMailer) recordFailure(backend *failoverBackend) {
+	if backend.breaker.failure() {
+		ObserveCircuitBreaker(backend.Name, true)
+		f.logger.Warnw("Opened circuit breaker", "backend", backend.Name)
+	}
+}
+
+// circuitBreaker opens after a number of consecutive failures. Once the cooldown has passed, it lets
+// a single probe through, which closes the breaker if it succeeds or opens it again if it fails.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	probing  bool
+	openedAt time.Time
+}
+
+func (c *circuitBreaker) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.open {
+		return true
+	}
+	if c.probing || c.now().Sub(c.openedAt) < c.cooldown {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// success returns true if the breaker was closed
+func (c *circuitBreaker) success() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	closed := c.open
+	c.failures = 0
+	c.open = false
+	c.probing = false
+	return closed
+}
+
+// failure returns true if the breaker was opened
+func (c *circuitBreaker) failure() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures++
+	if !c.probing && (c.open || c.failures < c.threshold) {
+		return false
+	}
+	opened := !c.open
+	c.open = true
+	c.probing = false
+	c.openedAt = c.now()
+	return opened
+}
+
+// release ends a probe which neither succeeded nor failed, e.g. because the context was cancelled
+func (c *circuitBreaker) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+}
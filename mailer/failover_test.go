@@ -0,0 +1,128 @@
+package mailer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+func newTestFailoverMailer(cooldown time.Duration, backends ...mailer.Mailer) *mailer.FailoverMailer {
+	params := &mailer.FailoverMailerParams{
+		Cfg:    &mailer.FailoverConfig{BreakerThreshold: 2, BreakerCooldown: cooldown},
+		Logger: zap.NewNop().Sugar(),
+	}
+	for i, backend := range backends {
+		params.Backends = append(params.Backends, mailer.FailoverBackend{Name: string(rune('a' + i)), Mailer: backend})
+	}
+	return mailer.NewFailoverMailer(params)
+}
+
+func Test_FailoverMailer_Send_FailsOverOnTransientErrors(t *testing.T) {
+	primary := &sequenceMailer{errs: []error{throttlingErr}}
+	secondary := &sequenceMailer{}
+	m := newTestFailoverMailer(time.Minute, primary, secondary)
+
+	id, err := m.Send(context.Background(), &mailer.Email{})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if id != "message-id" {
+		t.Fatalf(`Message id is "%s", but should be "message-id"`, id)
+	}
+	if primary.calls != 1 || secondary.calls != 1 {
+		t.Fatalf(`Expected a single attempt of each backend, got %v and %v`, primary.calls, secondary.calls)
+	}
+}
+
+func Test_FailoverMailer_Send_DoesNotFailOverOnPermanentErrors(t *testing.T) {
+	primary := &sequenceMailer{errs: []error{rejectedErr}}
+	secondary := &sequenceMailer{}
+	m := newTestFailoverMailer(time.Minute, primary, secondary)
+
+	if _, err := m.Send(context.Background(), &mailer.Email{}); !errors.Is(err, rejectedErr) {
+		t.Fatalf(`Error is "%v", but should be "%s"`, err, rejectedErr)
+	}
+	if secondary.calls != 0 {
+		t.Fatalf(`Expected no attempts of the secondary backend, got %v`, secondary.calls)
+	}
+}
+
+func Test_FailoverMailer_Send_AllBackendsFail(t *testing.T) {
+	primary := &sequenceMailer{errs: []error{throttlingErr}}
+	secondary := &sequenceMailer{errs: []error{throttlingErr}}
+	m := newTestFailoverMailer(time.Minute, primary, secondary)
+
+	_, err := m.Send(context.Background(), &mailer.Email{})
+	if !errors.Is(err, mailer.ErrNoBackendAvailable) || !errors.Is(err, throttlingErr) {
+		t.Fatalf(`Error is "%v", but should be "%s"`, err, mailer.ErrNoBackendAvailable)
+	}
+	if mailer.IsPermanent(err) {
+		t.Fatal("Error should not be permanent")
+	}
+	if attempts := mailer.Attempts(err); attempts != 2 {
+		t.Errorf(`Attempts are %v, but should be 2`, attempts)
+	}
+}
+
+func Test_FailoverMailer_Send_CircuitBreaker(t *testing.T) {
+	primary := &sequenceMailer{errs: []error{throttlingErr, throttlingErr, throttlingErr}}
+	secondary := &sequenceMailer{}
+	cooldown := 50 * time.Millisecond
+	m := newTestFailoverMailer(cooldown, primary, secondary)
+	ctx := context.Background()
+
+	// The breaker opens after two consecutive failures
+	for i := 0; i < 3; i++ {
+		if _, err := m.Send(ctx, &mailer.Email{}); err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+	}
+	if primary.calls != 2 || secondary.calls != 3 {
+		t.Fatalf(`Expected 2 attempts of the primary and 3 of the secondary backend, got %v and %v`, primary.calls, secondary.calls)
+	}
+
+	// The failed probe opens the breaker again
+	time.Sleep(cooldown)
+	if _, err := m.Send(ctx, &mailer.Email{}); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if _, err := m.Send(ctx, &mailer.Email{}); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if primary.calls != 3 || secondary.calls != 5 {
+		t.Fatalf(`Expected 3 attempts of the primary and 5 of the secondary backend, got %v and %v`, primary.calls, secondary.calls)
+	}
+
+	// The successful probe closes the breaker
+	time.Sleep(cooldown)
+	for i := 0; i < 2; i++ {
+		if _, err := m.Send(ctx, &mailer.Email{}); err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+	}
+	if primary.calls != 5 || secondary.calls != 5 {
+		t.Fatalf(`Expected 5 attempts of the primary and 5 of the secondary backend, got %v and %v`, primary.calls, secondary.calls)
+	}
+}
+
+func Test_New_FailoverChain(t *testing.T) {
+	m, err := mailer.New("console,console", zap.NewNop().Sugar(), validator.New())
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if _, ok := m.(*mailer.FailoverMailer); !ok {
+		t.Fatalf(`Mailer is %T, but should be a failover mailer`, m)
+	}
+
+	if _, err := mailer.New("console:us-west-2,smtp", zap.NewNop().Sugar(), validator.New()); err == nil {
+		t.Fatal("Error should not be nil")
+	}
+	if _, err := mailer.New("ses,sendgrid", zap.NewNop().Sugar(), validator.New()); err == nil {
+		t.Fatal("Error should not be nil")
+	}
+}
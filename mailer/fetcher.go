@@ -0,0 +1,357 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/go-playground/validator/v10"
+	"github.com/kelseyhightower/envconfig"
+)
+
+const (
+	SchemeHTTPS = "https"
+	SchemeS3    = "s3"
+)
+
+var (
+	ErrInvalidAttachmentReference = errors.New("invalid attachment reference")
+	ErrAttachmentUnavailable      = errors.New("attachment is unavailable")
+)
+
+// AttachmentFetcher fetches the content of an attachment which is referenced by url instead of being
+// embedded into the event, e.g. https://reports.tidepool.org/report.pdf or s3://bucket/report.pdf.
+// Invalid references fail with ErrInvalidAttachmentReference, content which doesn't exist or can't be
+// accessed fails with ErrAttachmentUnavailable and content exceeding the size limit fails with
+// ErrAttachmentTooLarge. Other errors are transient.
+type AttachmentFetcher interface {
+	Fetch(ctx context.Context, reference string) ([]byte, error)
+}
+
+type AttachmentFetcherConfig struct {
+	// AllowedHosts are the hosts (with the port if it's not 443) from which attachments can be fetched
+	// with https. Attachments can't be referenced by https urls if it's empty.
+	AllowedHosts []string      `envconfig:"TIDEPOOL_MAILER_ATTACHMENT_ALLOWED_HOSTS"`
+	MaxSize      int           `envconfig:"TIDEPOOL_MAILER_MAX_ATTACHMENT_SIZE" default:"10485760" validate:"min=1"`
+	Timeout      time.Duration `envconfig:"TIDEPOOL_MAILER_ATTACHMENT_FETCH_TIMEOUT" default:"10s" validate:"min=0"`
+	// AllowedBuckets are the buckets, optionally followed by a key prefix (e.g. reports/clinics), from which
+	// attachments can be fetched. The prefix is a directory, it doesn't match keys of sibling directories. Attachments can't be referenced by s3 urls if it's empty.
+	AllowedBuckets []string `envconfig:"TIDEPOOL_MAILER_ATTACHMENT_ALLOWED_BUCKETS" validate:"dive,required"`
+	// Dir is optional, s3://<bucket>/<key> references are read from <dir>/<bucket>/<key> instead of S3 if it's set
+	Dir        string `envconfig:"TIDEPOOL_MAILER_ATTACHMENT_DIR"`
+	S3Endpoint string `envconfig:"TIDEPOOL_MAILER_ATTACHMENT_S3_ENDPOINT" validate:"omitempty,url"`
+}
+
+// NewAttachmentFetcher returns a fetcher of https and s3 references
+func NewAttachmentFetcher(validate *validator.Validate) (AttachmentFetcher, error) {
+	cfg := &AttachmentFetcherConfig{}
+	if err := envconfig.Process("", cfg); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(cfg); err != nil {
+		return nil, err
+	}
+
+	fetchers := map[string]AttachmentFetcher{}
+	if len(cfg.AllowedHosts) > 0 {
+		fetchers[SchemeHTTPS] = NewHTTPAttachmentFetcher(&HTTPAttachmentFetcherParams{Cfg: cfg})
+	}
+	switch {
+	case len(cfg.AllowedBuckets) == 0:
+		// Attachments can't be referenced by s3 urls
+	case cfg.Dir != "":
+		fetchers[SchemeS3] = NewDirAttachmentFetcher(cfg)
+	default:
+		awsConfig, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		fetchers[SchemeS3] = NewS3AttachmentFetcher(cfg, s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+			if cfg.S3Endpoint != "" {
+				o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+				o.UsePathStyle = true
+			}
+		}))
+	}
+	return NewSchemeAttachmentFetcher(cfg, fetchers), nil
+}
+
+// SchemeAttachmentFetcher delegates to the fetcher of the reference scheme and limits the time of the fetch
+type SchemeAttachmentFetcher struct {
+	fetchers map[string]AttachmentFetcher
+	timeout  time.Duration
+}
+
+// Compile time interface check
+var _ AttachmentFetcher = &SchemeAttachmentFetcher{}
+
+func NewSchemeAttachmentFetcher(cfg *AttachmentFetcherConfig, fetchers map[string]AttachmentFetcher) *SchemeAttachmentFetcher {
+	return &SchemeAttachmentFetcher{
+		fetchers: fetchers,
+		timeout:  cfg.Timeout,
+	}
+}
+
+func (s *SchemeAttachmentFetcher) Fetch(ctx context.Context, reference string) ([]byte, error) {
+	u, err := url.Parse(reference)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAttachmentReference, err)
+	}
+	fetcher, ok := s.fetchers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported scheme of %s", ErrInvalidAttachmentReference, reference)
+	}
+
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	return fetcher.Fetch(ctx, reference)
+}
+
+// HTTPAttachmentFetcher fetches attachments from the allowed hosts with https
+type HTTPAttachmentFetcher struct {
+	allowedHosts map[string]bool
+	client       *http.Client
+	maxSize      int
+}
+
+// Compile time interface check
+var _ AttachmentFetcher = &HTTPAttachmentFetcher{}
+
+type HTTPAttachmentFetcherParams struct {
+	Cfg *AttachmentFetcherConfig
+	// Client is optional, a client with the configured timeout is used if it's not set
+	Client *http.Client
+}
+
+func NewHTTPAttachmentFetcher(params *HTTPAttachmentFetcherParams) *HTTPAttachmentFetcher {
+	fetcher := &HTTPAttachmentFetcher{
+		allowedHosts: make(map[string]bool, len(params.Cfg.AllowedHosts)),
+		maxSize:      params.Cfg.MaxSize,
+	}
+	for _, host := range params.Cfg.AllowedHosts {
+		fetcher.allowedHosts[strings.ToLower(strings.TrimSpace(host))] = true
+	}
+
+	client := &http.Client{Timeout: params.Cfg.Timeout}
+	if params.Client != nil {
+		c := *params.Client
+		client = &c
+	}
+	// Redirects must not escape the allowed hosts
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("%w: too many redirects", ErrAttachmentUnavailable)
+		}
+		return fetcher.validate(req.URL)
+	}
+	fetcher.client = client
+	return fetcher
+}
+
+func (h *HTTPAttachmentFetcher) Fetch(ctx context.Context, reference string) ([]byte, error) {
+	u, err := url.Parse(reference)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAttachmentReference, err)
+	}
+	if err := h.validate(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAttachmentReference, err)
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout:
+		return nil, fmt.Errorf("unable to fetch attachment %s: %s", reference, res.Status)
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: %s: %s", ErrAttachmentUnavailable, reference, res.Status)
+	case res.ContentLength > int64(h.maxSize):
+		return nil, fmt.Errorf("%w: %s has %d bytes, the limit is %d bytes", ErrAttachmentTooLarge, reference, res.ContentLength, h.maxSize)
+	}
+	return readAttachment(res.Body, reference, h.maxSize)
+}
+
+func (h *HTTPAttachmentFetcher) validate(u *url.URL) error {
+	if u.Scheme != SchemeHTTPS {
+		return fmt.Errorf("%w: %s is not an https url", ErrInvalidAttachmentReference, u.Redacted())
+	}
+	if !h.allowedHosts[strings.ToLower(u.Host)] {
+		return fmt.Errorf("%w: host %s is not allowed", ErrInvalidAttachmentReference, u.Host)
+	}
+	return nil
+}
+
+// S3API is the subset of the S3 client used to fetch attachments
+type S3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// S3AttachmentFetcher fetches attachments referenced by s3://<bucket>/<key> urls from the allowed buckets
+type S3AttachmentFetcher struct {
+	allowedBuckets s3AllowList
+	client         S3API
+	maxSize        int
+}
+
+// Compile time interface check
+var _ AttachmentFetcher = &S3AttachmentFetcher{}
+
+func NewS3AttachmentFetcher(cfg *AttachmentFetcherConfig, client S3API) *S3AttachmentFetcher {
+	return &S3AttachmentFetcher{
+		allowedBuckets: newS3AllowList(cfg.AllowedBuckets),
+		client:         client,
+		maxSize:        cfg.MaxSize,
+	}
+}
+
+func (s *S3AttachmentFetcher) Fetch(ctx context.Context, reference string) ([]byte, error) {
+	bucket, key, err := s.allowedBuckets.parse(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		var noSuchBucket *types.NoSuchBucket
+		var apiErr smithy.APIError
+		if errors.As(err, &noSuchKey) || errors.As(err, &noSuchBucket) || (errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied") {
+			return nil, fmt.Errorf("%w: %s: %w", ErrAttachmentUnavailable, reference, err)
+		}
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	if size := aws.ToInt64(output.ContentLength); size > int64(s.maxSize) {
+		return nil, fmt.Errorf("%w: %s has %d bytes, the limit is %d bytes", ErrAttachmentTooLarge, reference, size, s.maxSize)
+	}
+	return readAttachment(output.Body, reference, s.maxSize)
+}
+
+// DirAttachmentFetcher reads attachments referenced by s3://<bucket>/<key> urls of the allowed buckets from
+// <dir>/<bucket>/<key>, e.g. in development environments and tests
+type DirAttachmentFetcher struct {
+	allowedBuckets s3AllowList
+	dir            string
+	maxSize        int
+}
+
+// Compile time interface check
+var _ AttachmentFetcher = &DirAttachmentFetcher{}
+
+func NewDirAttachmentFetcher(cfg *AttachmentFetcherConfig) *DirAttachmentFetcher {
+	return &DirAttachmentFetcher{
+		allowedBuckets: newS3AllowList(cfg.AllowedBuckets),
+		dir:            cfg.Dir,
+		maxSize:        cfg.MaxSize,
+	}
+}
+
+func (d *DirAttachmentFetcher) Fetch(ctx context.Context, reference string) ([]byte, error) {
+	bucket, key, err := d.allowedBuckets.parse(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	// The root prevents keys from escaping the directory
+	root, err := os.OpenRoot(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	file, err := root.Open(path.Join(bucket, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s: %w", ErrAttachmentUnavailable, reference, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidAttachmentReference, reference, err)
+	}
+	defer file.Close()
+
+	return readAttachment(file, reference, d.maxSize)
+}
+
+// s3AllowList maps the allowed buckets to the allowed key prefixes, an empty prefix allows the whole bucket
+type s3AllowList map[string][]string
+
+// newS3AllowList parses the allowed <bucket> and <bucket>/<prefix> entries. The prefixes are directories,
+// so reports/clinics allows reports/clinics/report.pdf, but not reports/clinics-other/report.pdf.
+func newS3AllowList(entries []string) s3AllowList {
+	allowList := make(s3AllowList, len(entries))
+	for _, entry := range entries {
+		bucket, prefix, _ := strings.Cut(entry, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		allowList[bucket] = append(allowList[bucket], prefix)
+	}
+	return allowList
+}
+
+// parse returns the bucket and the key of the reference if the object is in one of the allowed locations
+func (a s3AllowList) parse(reference string) (string, string, error) {
+	bucket, key, err := parseS3Reference(reference)
+	if err != nil {
+		return "", "", err
+	}
+	// Keys with relative segments could escape the allowed prefix of a directory
+	if path.Clean("/"+key) != "/"+key {
+		return "", "", fmt.Errorf("%w: key of %s is not clean", ErrInvalidAttachmentReference, reference)
+	}
+	for _, prefix := range a[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			return bucket, key, nil
+		}
+	}
+	return "", "", fmt.Errorf("%w: %s is not in an allowed bucket", ErrInvalidAttachmentReference, reference)
+}
+
+func parseS3Reference(reference string) (string, string, error) {
+	u, err := url.Parse(reference)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrInvalidAttachmentReference, err)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != SchemeS3 || u.Host == "" || key == "" {
+		return "", "", fmt.Errorf("%w: %s is not an s3://<bucket>/<key> url", ErrInvalidAttachmentReference, reference)
+	}
+	return u.Host, key, nil
+}
+
+// readAttachment reads at most maxSize bytes, because the content length can be missing or wrong
+func readAttachment(reader io.Reader, reference string, maxSize int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("%w: %s exceeds %d bytes", ErrAttachmentTooLarge, reference, maxSize)
+	}
+	return data, nil
+}
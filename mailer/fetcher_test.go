@@ -0,0 +1,266 @@
+package mailer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/tidepool-org/mailer/mailer"
+)
+
+func newTestAttachmentServer(t *testing.T) (*httptest.Server, *mailer.HTTPAttachmentFetcher) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/report.pdf", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(pdf)
+	})
+	mux.HandleFunc("/large.pdf", func(w http.ResponseWriter, r *http.Request) {
+		// Flushing omits the content length, so the size can only be checked while reading
+		_, _ = w.Write(pdf)
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(bytes.Repeat([]byte("a"), 1024))
+	})
+	mux.HandleFunc("/unavailable.pdf", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/redirect.pdf", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://attacker.example.com/report.pdf", http.StatusFound)
+	})
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+
+	host, _ := url.Parse(server.URL)
+	fetcher := mailer.NewHTTPAttachmentFetcher(&mailer.HTTPAttachmentFetcherParams{
+		Cfg: &mailer.AttachmentFetcherConfig{
+			AllowedHosts: []string{host.Host},
+			MaxSize:      len(pdf),
+			Timeout:      time.Second,
+		},
+		Client: server.Client(),
+	})
+	return server, fetcher
+}
+
+func Test_HTTPAttachmentFetcher_Fetch_Success(t *testing.T) {
+	server, fetcher := newTestAttachmentServer(t)
+
+	data, err := fetcher.Fetch(context.Background(), server.URL+"/report.pdf")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if !bytes.Equal(data, pdf) {
+		t.Errorf(`Data is "%s", but should be "%s"`, data, pdf)
+	}
+}
+
+func Test_HTTPAttachmentFetcher_Fetch_Errors(t *testing.T) {
+	server, fetcher := newTestAttachmentServer(t)
+	tests := map[string]struct {
+		reference   string
+		expectedErr error
+	}{
+		"http url": {
+			reference:   "http" + server.URL[len("https"):] + "/report.pdf",
+			expectedErr: mailer.ErrInvalidAttachmentReference,
+		},
+		"host not allowed": {
+			reference:   "https://attacker.example.com/report.pdf",
+			expectedErr: mailer.ErrInvalidAttachmentReference,
+		},
+		"redirect to host not allowed": {
+			reference:   server.URL + "/redirect.pdf",
+			expectedErr: mailer.ErrInvalidAttachmentReference,
+		},
+		"not found": {
+			reference:   server.URL + "/missing.pdf",
+			expectedErr: mailer.ErrAttachmentUnavailable,
+		},
+		"too large": {
+			reference:   server.URL + "/large.pdf",
+			expectedErr: mailer.ErrAttachmentTooLarge,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := fetcher.Fetch(context.Background(), test.reference); !errors.Is(err, test.expectedErr) {
+				t.Fatalf(`Error is "%v", but should be "%s"`, err, test.expectedErr)
+			}
+		})
+	}
+}
+
+func Test_HTTPAttachmentFetcher_Fetch_TransientError(t *testing.T) {
+	server, fetcher := newTestAttachmentServer(t)
+
+	_, err := fetcher.Fetch(context.Background(), server.URL+"/unavailable.pdf")
+	if err == nil {
+		t.Fatal("Error should not be nil")
+	}
+	for _, permanent := range []error{mailer.ErrInvalidAttachmentReference, mailer.ErrAttachmentUnavailable, mailer.ErrAttachmentTooLarge} {
+		if errors.Is(err, permanent) {
+			t.Errorf(`Error is "%s", but should be transient`, err)
+		}
+	}
+}
+
+func Test_DirAttachmentFetcher_Fetch(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "reports", "2024"), 0o755); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "reports", "2024", "report.pdf"), pdf, 0o644); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if err := os.WriteFile(filepath.Join(filepath.Dir(dir), "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	fetcher := mailer.NewDirAttachmentFetcher(&mailer.AttachmentFetcherConfig{Dir: dir, MaxSize: 1024, AllowedBuckets: []string{"reports"}})
+
+	data, err := fetcher.Fetch(context.Background(), "s3://reports/2024/report.pdf")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if !bytes.Equal(data, pdf) {
+		t.Errorf(`Data is "%s", but should be "%s"`, data, pdf)
+	}
+
+	tests := map[string]struct {
+		reference   string
+		expectedErr error
+	}{
+		"missing key":        {reference: "s3://reports/2024/missing.pdf", expectedErr: mailer.ErrAttachmentUnavailable},
+		"without key":        {reference: "s3://reports", expectedErr: mailer.ErrInvalidAttachmentReference},
+		"https url":          {reference: "https://reports.tidepool.org/report.pdf", expectedErr: mailer.ErrInvalidAttachmentReference},
+		"escaping the dir":   {reference: "s3://reports/../../secret.txt", expectedErr: mailer.ErrInvalidAttachmentReference},
+		"bucket not allowed": {reference: "s3://secrets/2024/report.pdf", expectedErr: mailer.ErrInvalidAttachmentReference},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := fetcher.Fetch(context.Background(), test.reference); !errors.Is(err, test.expectedErr) {
+				t.Fatalf(`Error is "%v", but should be "%s"`, err, test.expectedErr)
+			}
+		})
+	}
+}
+
+type fakeS3 struct {
+	objects map[string][]byte
+	input   *s3.GetObjectInput
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.input = params
+	data, ok := f.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+	}, nil
+}
+
+func Test_S3AttachmentFetcher_Fetch(t *testing.T) {
+	client := &fakeS3{objects: map[string][]byte{
+		"reports/2024/report.pdf": pdf,
+		"reports/2024/large.pdf":  bytes.Repeat([]byte("a"), 2048),
+	}}
+	fetcher := mailer.NewS3AttachmentFetcher(&mailer.AttachmentFetcherConfig{MaxSize: 1024, AllowedBuckets: []string{"reports"}}, client)
+
+	data, err := fetcher.Fetch(context.Background(), "s3://reports/2024/report.pdf")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if !bytes.Equal(data, pdf) {
+		t.Errorf(`Data is "%s", but should be "%s"`, data, pdf)
+	}
+	if aws.ToString(client.input.Bucket) != "reports" || aws.ToString(client.input.Key) != "2024/report.pdf" {
+		t.Errorf(`Object is %s/%s, but should be reports/2024/report.pdf`, aws.ToString(client.input.Bucket), aws.ToString(client.input.Key))
+	}
+
+	if _, err := fetcher.Fetch(context.Background(), "s3://reports/2024/missing.pdf"); !errors.Is(err, mailer.ErrAttachmentUnavailable) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, mailer.ErrAttachmentUnavailable)
+	}
+	if _, err := fetcher.Fetch(context.Background(), "s3://reports/2024/large.pdf"); !errors.Is(err, mailer.ErrAttachmentTooLarge) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, mailer.ErrAttachmentTooLarge)
+	}
+}
+
+func Test_S3AttachmentFetcher_Fetch_AllowedBuckets(t *testing.T) {
+	client := &fakeS3{objects: map[string][]byte{
+		"reports/clinics/report.pdf":       pdf,
+		"reports/patients/report.pdf":      pdf,
+		"reports/clinics-other/report.pdf": pdf,
+		"reports/clinicsecret.pdf":         pdf,
+		"exports/report.pdf":               pdf,
+		"secrets/report.pdf":               pdf,
+	}}
+	fetcher := mailer.NewS3AttachmentFetcher(&mailer.AttachmentFetcherConfig{MaxSize: 1024, AllowedBuckets: []string{"reports/clinics/", "exports"}}, client)
+
+	for _, reference := range []string{"s3://reports/clinics/report.pdf", "s3://exports/report.pdf"} {
+		if _, err := fetcher.Fetch(context.Background(), reference); err != nil {
+			t.Errorf(`Error of %s is "%s", but should be nil`, reference, err)
+		}
+	}
+
+	client.input = nil
+	for _, reference := range []string{"s3://secrets/report.pdf", "s3://reports/patients/report.pdf", "s3://reports/clinics/../patients/report.pdf"} {
+		if _, err := fetcher.Fetch(context.Background(), reference); !errors.Is(err, mailer.ErrInvalidAttachmentReference) {
+			t.Errorf(`Error of %s is "%v", but should be "%s"`, reference, err, mailer.ErrInvalidAttachmentReference)
+		}
+	}
+	if client.input != nil {
+		t.Errorf(`Object %s/%s should not be requested`, aws.ToString(client.input.Bucket), aws.ToString(client.input.Key))
+	}
+
+	siblings := mailer.NewS3AttachmentFetcher(&mailer.AttachmentFetcherConfig{MaxSize: 1024, AllowedBuckets: []string{"reports/clinics"}}, client)
+	if _, err := siblings.Fetch(context.Background(), "s3://reports/clinics/report.pdf"); err != nil {
+		t.Errorf(`Error is "%s", but should be nil`, err)
+	}
+	client.input = nil
+	for _, reference := range []string{"s3://reports/clinics-other/report.pdf", "s3://reports/clinicsecret.pdf"} {
+		if _, err := siblings.Fetch(context.Background(), reference); !errors.Is(err, mailer.ErrInvalidAttachmentReference) {
+			t.Errorf(`Error of %s is "%v", but should be "%s"`, reference, err, mailer.ErrInvalidAttachmentReference)
+		}
+	}
+	if client.input != nil {
+		t.Errorf(`Object %s/%s should not be requested`, aws.ToString(client.input.Bucket), aws.ToString(client.input.Key))
+	}
+
+	disabled := mailer.NewS3AttachmentFetcher(&mailer.AttachmentFetcherConfig{MaxSize: 1024}, client)
+	if _, err := disabled.Fetch(context.Background(), "s3://reports/clinics/report.pdf"); !errors.Is(err, mailer.ErrInvalidAttachmentReference) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, mailer.ErrInvalidAttachmentReference)
+	}
+}
+
+type slowFetcher struct{}
+
+func (s slowFetcher) Fetch(ctx context.Context, reference string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func Test_SchemeAttachmentFetcher_Fetch(t *testing.T) {
+	fetcher := mailer.NewSchemeAttachmentFetcher(
+		&mailer.AttachmentFetcherConfig{Timeout: 10 * time.Millisecond},
+		map[string]mailer.AttachmentFetcher{mailer.SchemeS3: slowFetcher{}},
+	)
+
+	if _, err := fetcher.Fetch(context.Background(), "https://reports.tidepool.org/report.pdf"); !errors.Is(err, mailer.ErrInvalidAttachmentReference) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, mailer.ErrInvalidAttachmentReference)
+	}
+	if _, err := fetcher.Fetch(context.Background(), "s3://reports/report.pdf"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,133 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	FileMailerBackendID = "file"
+
+	FileFormatEML     = "eml"
+	FileFormatMaildir = "maildir"
+)
+
+// FileMailer writes the messages as RFC 5322 files, so they can be opened in a mail client or parsed
+// by tests. The envelope is prepended as Return-Path and X-Envelope-To headers, because the bcc
+// recipients are not part of the message.
+type FileMailer struct {
+	cfg      *FileMailerConfig
+	dkim     *DKIMSigner
+	logger   *zap.SugaredLogger
+	hostname string
+	counter  atomic.Uint64
+}
+
+// Compile time interface check
+var _ Mailer = &FileMailer{}
+
+type FileMailerConfig struct {
+	SenderName    string `envconfig:"TIDEPOOL_EMAIL_SENDER_NAME" default:"Tidepool"`
+	SenderAddress string `envconfig:"TIDEPOOL_EMAIL_SENDER_ADDRESS" default:"noreply@tidepool.org" validate:"email"`
+	Dir           string `envconfig:"TIDEPOOL_MAILER_FILE_DIR" default:"emails" validate:"required"`
+	// Format is either eml, which writes <dir>/<time>_<message id>.eml files, or maildir
+	Format string `envconfig:"TIDEPOOL_MAILER_FILE_FORMAT" default:"eml" validate:"oneof=eml maildir"`
+}
+
+type FileMailerParams struct {
+	Cfg *FileMailerConfig
+	// DKIM is optional, the messages are not signed if it's not set
+	DKIM   *DKIMSigner
+	Logger *zap.SugaredLogger
+}
+
+func NewFileMailer(params *FileMailerParams) (*FileMailer, error) {
+	dirs := []string{params.Cfg.Dir}
+	if params.Cfg.Format == FileFormatMaildir {
+		dirs = []string{filepath.Join(params.Cfg.Dir, "tmp"), filepath.Join(params.Cfg.Dir, "new"), filepath.Join(params.Cfg.Dir, "cur")}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+
+	return &FileMailer{
+		cfg:    params.Cfg,
+		dkim:   params.DKIM,
+		logger: params.Logger.With(zap.String("backend", FileMailerBackendID)),
+		// Maildir file names can't contain slashes or colons
+		hostname: strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname),
+	}, nil
+}
+
+func (f *FileMailer) Send(ctx context.Context, email *Email) (string, error) {
+	msg, err := NewMessage(email, f.cfg.SenderAddress, f.cfg.SenderName)
+	if err != nil {
+		f.logger.Errorw("Error while creating message", "error", err, "recipients", email.Recipients, "cc", email.Cc)
+		return "", NewPermanentError(err)
+	}
+	if err := msg.Sign(f.dkim); err != nil {
+		f.logger.Errorw("Error while signing message", "error", err)
+		return "", NewPermanentError(err)
+	}
+
+	data := bytes.Buffer{}
+	fmt.Fprintf(&data, "Return-Path: <%s>\r\n", msg.Sender)
+	fmt.Fprintf(&data, "X-Envelope-To: %s\r\n", strings.Join(msg.Destinations, ", "))
+	data.Write(msg.Data)
+
+	path, err := f.write(msg.ID, data.Bytes())
+	if err != nil {
+		f.logger.Errorw("Error while writing message", "error", err)
+		return "", fmt.Errorf("unable to write message: %w", err)
+	}
+
+	f.logger.Infow("Successfully wrote message", "id", msg.ID, "path", path)
+	return msg.ID, nil
+}
+
+// write writes the message into a temporary file first, so readers never see partially written messages
+func (f *FileMailer) write(id string, data []byte) (string, error) {
+	now := time.Now()
+	tmpDir, dir := f.cfg.Dir, f.cfg.Dir
+	name := fmt.Sprintf("%s_%s.eml", now.UTC().Format("20060102T150405.000000000Z"), strings.ReplaceAll(id, "@", "_"))
+	if f.cfg.Format == FileFormatMaildir {
+		tmpDir, dir = filepath.Join(f.cfg.Dir, "tmp"), filepath.Join(f.cfg.Dir, "new")
+		name = fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), f.counter.Add(1), f.hostname)
+	}
+
+	tmp, err := os.CreateTemp(tmpDir, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,117 @@
+package mailer_test
+
+import (
+	"context"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+func newTestFileMailer(t *testing.T, format string) (*mailer.FileMailer, string) {
+	dir := t.TempDir()
+	m, err := mailer.NewFileMailer(&mailer.FileMailerParams{
+		Cfg: &mailer.FileMailerConfig{
+			SenderName:    "Tidepool",
+			SenderAddress: "noreply@tidepool.org",
+			Dir:           dir,
+			Format:        format,
+		},
+		Logger: zap.NewNop().Sugar(),
+	})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	return m, dir
+}
+
+func readTestMessages(t *testing.T, dir string) []*mail.Message {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	var messages []*mail.Message
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+		t.Cleanup(func() { _ = f.Close() })
+		msg, err := mail.ReadMessage(f)
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func Test_FileMailer_Send_EML(t *testing.T) {
+	m, dir := newTestFileMailer(t, mailer.FileFormatEML)
+
+	id, err := m.Send(context.Background(), &mailer.Email{
+		Recipients: []string{"patient@example.com"},
+		Bcc:        []string{"admin@example.com"},
+		Subject:    "Subject",
+		Body:       "<p>Body</p>",
+		TextBody:   "Body",
+	})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	messages := readTestMessages(t, dir)
+	if len(messages) != 1 {
+		t.Fatalf(`Expected a single message, got %v`, len(messages))
+	}
+	msg := messages[0]
+	if msg.Header.Get("Message-Id") != "<"+id+">" {
+		t.Errorf(`Message-Id is "%s", but should be "<%s>"`, msg.Header.Get("Message-Id"), id)
+	}
+	if msg.Header.Get("Subject") != "Subject" || msg.Header.Get("To") != "patient@example.com" || msg.Header.Get("Date") == "" {
+		t.Errorf(`Unexpected headers %v`, msg.Header)
+	}
+	if msg.Header.Get("Return-Path") != "<noreply@tidepool.org>" || msg.Header.Get("X-Envelope-To") != "patient@example.com, admin@example.com" {
+		t.Errorf(`Unexpected envelope headers %v`, msg.Header)
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Errorf(`Message should not contain the bcc header, got %s`, msg.Header.Get("Bcc"))
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if !strings.Contains(string(body), "<p>Body</p>") {
+		t.Errorf(`Body should contain the html body, got %s`, body)
+	}
+}
+
+func Test_FileMailer_Send_Maildir(t *testing.T) {
+	m, dir := newTestFileMailer(t, mailer.FileFormatMaildir)
+
+	for i := 0; i < 2; i++ {
+		_, err := m.Send(context.Background(), &mailer.Email{
+			Recipients: []string{"patient@example.com"},
+			Subject:    "Subject",
+			Body:       "<p>Body</p>",
+		})
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+	}
+
+	if messages := readTestMessages(t, filepath.Join(dir, "new")); len(messages) != 2 {
+		t.Fatalf(`Expected 2 new messages, got %v`, len(messages))
+	}
+	for _, subdir := range []string{"tmp", "cur"} {
+		if entries, err := os.ReadDir(filepath.Join(dir, subdir)); err != nil || len(entries) != 0 {
+			t.Fatalf(`Expected %s to be empty, got %v and "%v"`, subdir, entries, err)
+		}
+	}
+}
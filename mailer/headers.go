@@ -0,0 +1,78 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+var ErrInvalidHeader = errors.New("invalid header")
+
+// reservedHeaders are set by the mailer and can't be overridden by custom headers
+var reservedHeaders = map[string]bool{
+	"Bcc":                       true,
+	"Cc":                        true,
+	"Content-Disposition":       true,
+	"Content-Transfer-Encoding": true,
+	"Content-Type":              true,
+	"Date":                      true,
+	"Dkim-Signature":            true,
+	"From":                      true,
+	"List-Unsubscribe":          true,
+	"List-Unsubscribe-Post":     true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Reply-To":                  true,
+	"Return-Path":               true,
+	"Sender":                    true,
+	"Subject":                   true,
+	"To":                        true,
+}
+
+const (
+	listUnsubscribeHeader     = "List-Unsubscribe"
+	listUnsubscribePostHeader = "List-Unsubscribe-Post"
+	listUnsubscribeOneClick   = "List-Unsubscribe=One-Click"
+)
+
+// ValidateHeaders checks that the custom header names are valid RFC 5322 field names which are
+// not reserved by the mailer or set twice with different cases, and that the values can't inject
+// additional headers
+func ValidateHeaders(headers map[string]string) error {
+	seen := make(map[string]bool, len(headers))
+	for name, value := range headers {
+		if name == "" {
+			return fmt.Errorf("%w: name is empty", ErrInvalidHeader)
+		}
+		for _, c := range name {
+			if c < '!' || c > '~' || c == ':' {
+				return fmt.Errorf("%w %q: name contains invalid characters", ErrInvalidHeader, name)
+			}
+		}
+		canonical := textproto.CanonicalMIMEHeaderKey(name)
+		if reservedHeaders[canonical] {
+			return fmt.Errorf("%w %q: header is reserved", ErrInvalidHeader, name)
+		}
+		if seen[canonical] {
+			return fmt.Errorf("%w %q: header is set more than once", ErrInvalidHeader, name)
+		}
+		seen[canonical] = true
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("%w %q: value contains line breaks", ErrInvalidHeader, name)
+		}
+	}
+	return nil
+}
+
+// MergeHeaders sets the headers in the destination with their canonical names, so headers which only
+// differ in case replace each other. It returns the destination, which is allocated if it's nil.
+func MergeHeaders(dst map[string]string, headers map[string]string) map[string]string {
+	if dst == nil && len(headers) > 0 {
+		dst = make(map[string]string, len(headers))
+	}
+	for name, value := range headers {
+		dst[textproto.CanonicalMIMEHeaderKey(name)] = value
+	}
+	return dst
+}
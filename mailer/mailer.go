@@ -7,6 +7,7 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"strings"
 )
 
 const (
@@ -20,25 +21,125 @@ func (b *Backend) Decode(value string) error {
 	return nil
 }
 
+// Email is the message delivered by the mailer backends. Bcc recipients are added to the envelope,
+// but they are never written into the message headers. Custom headers must pass ValidateHeaders.
+// The backend's default sender is used when From (e.g. "Tidepool <noreply@tidepool.org>") is empty.
+// ConfigurationSet, ListManagement and Tags are only used by the SES backend. Tags must pass ValidateTags.
+// The RFC 8058 one-click List-Unsubscribe headers are added when UnsubscribeURL is set.
 type Email struct {
-	Recipients  []string     `json:"recipients" validate:"min=1,email"`
-	Cc          []string     `json:"cc" validate:"email"`
-	Subject     string       `json:"subject" validate:"required"`
-	Body        string       `json:"body" validate:"required"`
-	Attachments []Attachment `json:"attachments"`
+	From             string            `json:"from"`
+	Recipients       []string          `json:"recipients" validate:"min=1,dive,email"`
+	Cc               []string          `json:"cc" validate:"dive,email"`
+	Bcc              []string          `json:"bcc" validate:"dive,email"`
+	ReplyTo          string            `json:"reply_to" validate:"omitempty,email"`
+	Headers          map[string]string `json:"headers"`
+	Subject          string            `json:"subject" validate:"required"`
+	Body             string            `json:"body" validate:"required"`
+	TextBody         string            `json:"text_body"`
+	Attachments      []Attachment      `json:"attachments"`
+	ConfigurationSet string            `json:"configuration_set"`
+	ListManagement   *ListManagement   `json:"list_management"`
+	Tags             map[string]string `json:"tags"`
+	UnsubscribeURL   string            `json:"unsubscribe_url" validate:"omitempty,url"`
 }
 
+// ListManagement adds the SES unsubscribe link and headers of the contact list topic to the email
+type ListManagement struct {
+	ContactList string `json:"contact_list" validate:"required"`
+	Topic       string `json:"topic"`
+}
+
+const (
+	DispositionAttachment = "attachment"
+	DispositionInline     = "inline"
+)
+
 type Attachment struct {
 	ContentType string `json:"content_type" validate:"required"`
 	Data        string `json:"content" validate:"required"`
 	Filename    string `json:"filename" validate:"required"`
+	// Disposition is either attachment, which is the default, or inline. Inline attachments are
+	// added to a multipart/related part and can be referenced by the html body with cid: urls.
+	Disposition string `json:"disposition,omitempty" validate:"omitempty,oneof=attachment inline"`
+	// ContentID is optional, inline attachments are identified by their filename if it's not set
+	ContentID string `json:"content_id,omitempty"`
+}
+
+// IsInline returns true if the attachment is displayed within the html body
+func (a Attachment) IsInline() bool {
+	return a.Disposition == DispositionInline
 }
 
 type Mailer interface {
-	Send(ctx context.Context, email *Email) error
+	// Send delivers the email and returns the message id assigned by the backend
+	Send(ctx context.Context, email *Email) (string, error)
 }
 
+// New creates the mailer backend. The id is either a single backend or an ordered failover chain of
+// backends, e.g. "ses:us-west-2,ses:us-east-1,smtp". The region of SES backends can be set after a colon.
 func New(id Backend, logger *zap.SugaredLogger, validate *validator.Validate) (Mailer, error) {
+	names := strings.Split(string(id), ",")
+	if len(names) == 1 {
+		return newRetryingBackend(names[0], logger, validate)
+	}
+
+	failoverConfig := &FailoverConfig{}
+	if err := envconfig.Process("", failoverConfig); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(failoverConfig); err != nil {
+		return nil, err
+	}
+
+	backends := make([]FailoverBackend, len(names))
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		backend, err := newRetryingBackend(name, logger, validate)
+		if err != nil {
+			return nil, err
+		}
+		backends[i] = FailoverBackend{Name: name, Mailer: backend}
+	}
+
+	logger.Infow("Creating new failover mailer", "backends", names)
+	return NewFailoverMailer(&FailoverMailerParams{
+		Backends: backends,
+		Cfg:      failoverConfig,
+		Logger:   logger,
+	}), nil
+}
+
+func newRetryingBackend(name string, logger *zap.SugaredLogger, validate *validator.Validate) (Mailer, error) {
+	id, region, _ := strings.Cut(name, ":")
+	backend, err := newBackend(Backend(id), region, logger, validate)
+	if err != nil {
+		return nil, err
+	}
+	if id == ConsoleMailerBackendID || id == FileMailerBackendID || id == MemoryMailerBackendID {
+		return backend, nil
+	}
+
+	retryConfig := &RetryConfig{}
+	if err := envconfig.Process("", retryConfig); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(retryConfig); err != nil {
+		return nil, err
+	}
+
+	return NewRetryingMailer(&RetryingMailerParams{
+		Backend:  name,
+		Cfg:      retryConfig,
+		Delegate: backend,
+		Logger:   logger,
+	}), nil
+}
+
+func newBackend(id Backend, region string, logger *zap.SugaredLogger, validate *validator.Validate) (Mailer, error) {
+	if region != "" && id != SESMailerBackendID {
+		return nil, fmt.Errorf("mailer backend %s doesn't support a region", id)
+	}
+
 	switch id {
 	case SESMailerBackendID:
 		logger.Info("Creating new ses mailer backend")
@@ -46,6 +147,9 @@ func New(id Backend, logger *zap.SugaredLogger, validate *validator.Validate) (M
 		if err := envconfig.Process("", backendConfig); err != nil {
 			return nil, err
 		}
+		if region != "" {
+			backendConfig.Region = region
+		}
 		if err := validate.Struct(backendConfig); err != nil {
 			return nil, err
 		}
@@ -55,6 +159,69 @@ func New(id Backend, logger *zap.SugaredLogger, validate *validator.Validate) (M
 			Logger: logger,
 		}
 		return NewSESMailer(params)
+	case SMTPMailerBackendID:
+		logger.Info("Creating new smtp mailer backend")
+		backendConfig := &SMTPMailerConfig{}
+		if err := envconfig.Process("", backendConfig); err != nil {
+			return nil, err
+		}
+		if err := validate.Struct(backendConfig); err != nil {
+			return nil, err
+		}
+
+		dkim, err := newDKIMSigner(validate)
+		if err != nil {
+			return nil, err
+		}
+
+		params := &SMTPMailerParams{
+			Cfg:    backendConfig,
+			DKIM:   dkim,
+			Logger: logger,
+		}
+		return NewSMTPMailer(params)
+	case FileMailerBackendID:
+		logger.Info("Creating new file mailer backend")
+		backendConfig := &FileMailerConfig{}
+		if err := envconfig.Process("", backendConfig); err != nil {
+			return nil, err
+		}
+		if err := validate.Struct(backendConfig); err != nil {
+			return nil, err
+		}
+
+		dkim, err := newDKIMSigner(validate)
+		if err != nil {
+			return nil, err
+		}
+
+		params := &FileMailerParams{
+			Cfg:    backendConfig,
+			DKIM:   dkim,
+			Logger: logger,
+		}
+		return NewFileMailer(params)
+	case MemoryMailerBackendID:
+		logger.Info("Creating new memory mailer backend")
+		backendConfig := &MemoryMailerConfig{}
+		if err := envconfig.Process("", backendConfig); err != nil {
+			return nil, err
+		}
+		if err := validate.Struct(backendConfig); err != nil {
+			return nil, err
+		}
+
+		dkim, err := newDKIMSigner(validate)
+		if err != nil {
+			return nil, err
+		}
+
+		params := &MemoryMailerParams{
+			Cfg:    backendConfig,
+			DKIM:   dkim,
+			Logger: logger,
+		}
+		return NewMemoryMailer(params), nil
 	case ConsoleMailerBackendID:
 		logger.Info("Creating new console mailer backend")
 		return NewConsoleMailer(logger), nil
@@ -62,3 +229,14 @@ func New(id Backend, logger *zap.SugaredLogger, validate *validator.Validate) (M
 		return nil, errors.New(fmt.Sprintf("unknown mailer backend %s", id))
 	}
 }
+
+func newDKIMSigner(validate *validator.Validate) (*DKIMSigner, error) {
+	cfg := &DKIMConfig{}
+	if err := envconfig.Process("", cfg); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(cfg); err != nil {
+		return nil, err
+	}
+	return NewDKIMSigner(cfg)
+}
@@ -0,0 +1,134 @@
+package mailer
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	MemoryMailerBackendID = "memory"
+)
+
+// CapturedEmail is an email retained by the memory backend together with its raw MIME representation
+type CapturedEmail struct {
+	ID       string    `json:"id"`
+	Email    Email     `json:"email"`
+	Raw      []byte    `json:"-"`
+	SentTime time.Time `json:"sent_time"`
+}
+
+// MemoryMailer retains the last emails instead of delivering them, so they can be inspected by
+// end-to-end tests. The oldest emails are discarded when the capacity is exceeded.
+type MemoryMailer struct {
+	cfg    *MemoryMailerConfig
+	dkim   *DKIMSigner
+	logger *zap.SugaredLogger
+
+	mu     sync.Mutex
+	emails []CapturedEmail
+}
+
+// Compile time interface check
+var _ Mailer = &MemoryMailer{}
+
+type MemoryMailerConfig struct {
+	SenderName    string `envconfig:"TIDEPOOL_EMAIL_SENDER_NAME" default:"Tidepool"`
+	SenderAddress string `envconfig:"TIDEPOOL_EMAIL_SENDER_ADDRESS" default:"noreply@tidepool.org" validate:"email"`
+	Capacity      int    `envconfig:"TIDEPOOL_MAILER_MEMORY_CAPACITY" default:"100" validate:"min=1"`
+}
+
+type MemoryMailerParams struct {
+	Cfg *MemoryMailerConfig
+	// DKIM is optional, the messages are not signed if it's not set
+	DKIM   *DKIMSigner
+	Logger *zap.SugaredLogger
+}
+
+func NewMemoryMailer(params *MemoryMailerParams) *MemoryMailer {
+	return &MemoryMailer{
+		cfg:    params.Cfg,
+		dkim:   params.DKIM,
+		logger: params.Logger.With(zap.String("backend", MemoryMailerBackendID)),
+		emails: make([]CapturedEmail, 0, params.Cfg.Capacity),
+	}
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, email *Email) (string, error) {
+	msg, err := NewMessage(email, m.cfg.SenderAddress, m.cfg.SenderName)
+	if err != nil {
+		m.logger.Errorw("Error while creating message", "error", err, "recipients", email.Recipients, "cc", email.Cc)
+		return "", NewPermanentError(err)
+	}
+	if err := msg.Sign(m.dkim); err != nil {
+		m.logger.Errorw("Error while signing message", "error", err)
+		return "", NewPermanentError(err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.emails) == m.cfg.Capacity {
+		m.emails = append(m.emails[:0], m.emails[1:]...)
+	}
+	m.emails = append(m.emails, CapturedEmail{
+		ID:       msg.ID,
+		Email:    *email,
+		Raw:      msg.Data,
+		SentTime: time.Now(),
+	})
+
+	m.logger.Infow("Captured message", "id", msg.ID)
+	return msg.ID, nil
+}
+
+// List returns the retained emails, the oldest first
+func (m *MemoryMailer) List() []CapturedEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]CapturedEmail{}, m.emails...)
+}
+
+// ListByRecipient returns the retained emails which were sent to, cc'ed or bcc'ed to the address
+func (m *MemoryMailer) ListByRecipient(address string) []CapturedEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	emails := []CapturedEmail{}
+	for _, captured := range m.emails {
+		if containsAddress(captured.Email.Recipients, address) || containsAddress(captured.Email.Cc, address) || containsAddress(captured.Email.Bcc, address) {
+			emails = append(emails, captured)
+		}
+	}
+	return emails
+}
+
+// Get returns nil if no retained email has the id
+func (m *MemoryMailer) Get(id string) *CapturedEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, captured := range m.emails {
+		if captured.ID == id {
+			return &captured
+		}
+	}
+	return nil
+}
+
+// Clear discards all retained emails
+func (m *MemoryMailer) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.emails = m.emails[:0]
+}
+
+func containsAddress(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if strings.EqualFold(a, address) {
+			return true
+		}
+	}
+	return false
+}
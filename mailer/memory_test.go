@@ -0,0 +1,52 @@
+package mailer_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+func Test_MemoryMailer_Send_RetainsLastEmails(t *testing.T) {
+	m := mailer.NewMemoryMailer(&mailer.MemoryMailerParams{
+		Cfg:    &mailer.MemoryMailerConfig{SenderName: "Tidepool", SenderAddress: "noreply@tidepool.org", Capacity: 2},
+		Logger: zap.NewNop().Sugar(),
+	})
+
+	var ids []string
+	for _, subject := range []string{"First", "Second", "Third"} {
+		id, err := m.Send(context.Background(), &mailer.Email{
+			Recipients: []string{"patient@example.com"},
+			Bcc:        []string{"admin@example.com"},
+			Subject:    subject,
+			Body:       "<p>Body</p>",
+		})
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+		ids = append(ids, id)
+	}
+
+	emails := m.List()
+	if len(emails) != 2 || emails[0].Email.Subject != "Second" || emails[1].Email.Subject != "Third" {
+		t.Fatalf(`Emails are %v, but should be the last two`, emails)
+	}
+	if m.Get(ids[0]) != nil {
+		t.Fatal("The oldest email should be discarded")
+	}
+	if captured := m.Get(ids[2]); captured == nil || len(captured.Raw) == 0 {
+		t.Fatalf(`Expected the raw message of the last email, got %v`, captured)
+	}
+	if emails := m.ListByRecipient("admin@example.com"); len(emails) != 2 {
+		t.Fatalf(`Expected 2 emails bcc'ed to the admin, got %v`, len(emails))
+	}
+	if emails := m.ListByRecipient("clinic@example.com"); len(emails) != 0 {
+		t.Fatalf(`Expected no emails to the clinic, got %v`, len(emails))
+	}
+
+	m.Clear()
+	if emails := m.List(); len(emails) != 0 {
+		t.Fatalf(`Expected no emails after clearing, got %v`, len(emails))
+	}
+}
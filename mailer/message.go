@@ -0,0 +1,172 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"gopkg.in/gomail.v2"
+)
+
+// Message is the raw MIME representation of an email together with its envelope
+type Message struct {
+	// ID is the value of the Message-ID header without the angle brackets
+	ID string
+	// Sender is the envelope sender address
+	Sender string
+	// Destinations are the punycoded envelope recipient addresses
+	Destinations []string
+	// Data is the RFC 5322 encoded message
+	Data []byte
+}
+
+// NewMessage builds the raw MIME message for backends which deliver pre-encoded messages
+func NewMessage(email *Email, senderAddress string, senderName string) (*Message, error) {
+	toAddresses, err := addresses(email.Recipients)
+	if err != nil {
+		return nil, err
+	}
+	ccAddresses, err := addresses(email.Cc)
+	if err != nil {
+		return nil, err
+	}
+	bccAddresses, err := addresses(email.Bcc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateHeaders(email.Headers); err != nil {
+		return nil, err
+	}
+	if email.From != "" {
+		from, err := mail.ParseAddress(email.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sender %s: %w", email.From, err)
+		}
+		senderAddress, senderName = from.Address, from.Name
+	}
+
+	id, err := newMessageID(senderAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := gomail.NewMessage()
+	msg.SetHeader("Message-ID", fmt.Sprintf("<%s>", id))
+	msg.SetHeader("To", email.Recipients...)
+	msg.SetAddressHeader("From", senderAddress, senderName)
+	msg.SetHeader("Subject", email.Subject)
+	if email.ReplyTo != "" {
+		msg.SetHeader("Reply-To", email.ReplyTo)
+	}
+	for name, value := range MergeHeaders(nil, email.Headers) {
+		msg.SetHeader(name, value)
+	}
+	if email.UnsubscribeURL != "" {
+		if strings.ContainsAny(email.UnsubscribeURL, "\r\n<>") {
+			return nil, fmt.Errorf("%w: invalid unsubscribe url", ErrInvalidHeader)
+		}
+		msg.SetHeader(listUnsubscribeHeader, fmt.Sprintf("<%s>", email.UnsubscribeURL))
+		msg.SetHeader(listUnsubscribePostHeader, listUnsubscribeOneClick)
+	}
+	if email.TextBody != "" {
+		msg.SetBody("text/plain", email.TextBody)
+		msg.AddAlternative("text/html", email.Body)
+	} else {
+		msg.SetBody("text/html", email.Body)
+	}
+	if len(email.Cc) > 0 {
+		msg.SetHeader("cc", ccAddresses...)
+	}
+
+	for _, attachment := range email.Attachments {
+		copyFunc := gomail.SetCopyFunc(func(writer io.Writer) error {
+			reader := base64.NewDecoder(base64.StdEncoding, strings.NewReader(attachment.Data))
+			_, err := io.Copy(writer, reader)
+			return err
+		})
+		headers := map[string][]string{
+			"Content-Type": {attachment.ContentType},
+		}
+		if !attachment.IsInline() {
+			msg.Attach(attachment.Filename, copyFunc, gomail.SetHeader(headers))
+			continue
+		}
+
+		contentID := attachment.ContentID
+		if contentID == "" {
+			contentID = attachment.Filename
+		}
+		headers["Content-ID"] = []string{fmt.Sprintf("<%s>", contentID)}
+		msg.Embed(attachment.Filename, copyFunc, gomail.SetHeader(headers))
+	}
+
+	// create a new buffer to add raw data
+	var emailRaw bytes.Buffer
+	if _, err = msg.WriteTo(&emailRaw); err != nil {
+		return nil, err
+	}
+
+	destinations := make([]string, 0, len(toAddresses)+len(ccAddresses)+len(bccAddresses))
+	destinations = append(destinations, toAddresses...)
+	destinations = append(destinations, ccAddresses...)
+	destinations = append(destinations, bccAddresses...)
+
+	return &Message{
+		ID:           id,
+		Sender:       senderAddress,
+		Destinations: destinations,
+		Data:         emailRaw.Bytes(),
+	}, nil
+}
+
+// Sign prepends the DKIM signature to the message data, it does nothing if the signer is nil
+func (m *Message) Sign(signer *DKIMSigner) error {
+	if signer == nil {
+		return nil
+	}
+	data, err := signer.Sign(m.Data)
+	if err != nil {
+		return err
+	}
+	m.Data = data
+	return nil
+}
+
+func newMessageID(senderAddress string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	domain := "localhost"
+	if i := strings.LastIndex(senderAddress, "@"); i >= 0 {
+		domain = senderAddress[i+1:]
+	}
+	return fmt.Sprintf("%s@%s", hex.EncodeToString(b), domain), nil
+}
+
+func FormatSender(name, address string) string {
+	if name == "" {
+		return address
+	}
+	return fmt.Sprintf("%s <%s>", name, address)
+}
+
+func addresses(emails []string) ([]string, error) {
+	addr := make([]string, 0, len(emails))
+	for _, recipient := range emails {
+		escapedRecipient, err := idna.ToASCII(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("unable to Punycode email: %w", err)
+		}
+		addr = append(addr, escapedRecipient)
+	}
+	return addr, nil
+}
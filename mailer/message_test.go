@@ -0,0 +1,154 @@
+package mailer_test
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tidepool-org/mailer/mailer"
+)
+
+func Test_NewMessage_Bcc(t *testing.T) {
+	msg, err := mailer.NewMessage(&mailer.Email{
+		Recipients: []string{"patient@example.com", "caregiver@example.com"},
+		Cc:         []string{"clinic@example.com"},
+		Bcc:        []string{"admin@example.com"},
+		Subject:    "Subject",
+		Body:       "<p>Body</p>",
+	}, "sender@tidepool.org", "Tidepool")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	expectedDestinations := []string{"patient@example.com", "caregiver@example.com", "clinic@example.com", "admin@example.com"}
+	if !slices.Equal(msg.Destinations, expectedDestinations) {
+		t.Fatalf(`Destinations are %v, but should be %v`, msg.Destinations, expectedDestinations)
+	}
+	data := string(msg.Data)
+	if !strings.Contains(data, "patient@example.com, caregiver@example.com") || !strings.Contains(data, "clinic@example.com") {
+		t.Fatalf(`Message should contain the to and cc recipients, got %s`, data)
+	}
+	if strings.Contains(data, "admin@example.com") || strings.Contains(strings.ToLower(data), "bcc:") {
+		t.Fatalf(`Message should not contain the bcc recipients, got %s`, data)
+	}
+}
+
+func Test_NewMessage_ReplyToAndHeaders(t *testing.T) {
+	msg, err := mailer.NewMessage(&mailer.Email{
+		Recipients: []string{"patient@example.com"},
+		ReplyTo:    "support@clinic.example.com",
+		Headers:    map[string]string{"X-Tidepool-Clinic-Id": "clinic-123"},
+		Subject:    "Subject",
+		Body:       "<p>Body</p>",
+	}, "sender@tidepool.org", "Tidepool")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	data := string(msg.Data)
+	for _, header := range []string{"Reply-To: support@clinic.example.com\r\n", "X-Tidepool-Clinic-Id: clinic-123\r\n"} {
+		if !strings.Contains(data, header) {
+			t.Errorf(`Message should contain header %q, got %s`, header, data)
+		}
+	}
+}
+
+func Test_NewMessage_UnsubscribeURL(t *testing.T) {
+	msg, err := mailer.NewMessage(&mailer.Email{
+		Recipients:     []string{"patient@example.com"},
+		Subject:        "Subject",
+		Body:           "<p>Body</p>",
+		UnsubscribeURL: "https://api.tidepool.org/v1/unsubscribe?token=abc",
+	}, "sender@tidepool.org", "Tidepool")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	data := string(msg.Data)
+	for _, header := range []string{"List-Unsubscribe: <https://api.tidepool.org/v1/unsubscribe?token=abc>\r\n", "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n"} {
+		if !strings.Contains(data, header) {
+			t.Errorf(`Message should contain header %q, got %s`, header, data)
+		}
+	}
+}
+
+func Test_ValidateHeaders(t *testing.T) {
+	tests := map[string]struct {
+		headers map[string]string
+		valid   bool
+	}{
+		"custom header":         {headers: map[string]string{"X-Tidepool-Trace": "abc"}, valid: true},
+		"reserved header":       {headers: map[string]string{"bcc": "attacker@example.com"}},
+		"content disposition":   {headers: map[string]string{"content-disposition": "attachment"}},
+		"dkim signature":        {headers: map[string]string{"DKIM-Signature": "v=1; d=attacker.example.com"}},
+		"list unsubscribe":      {headers: map[string]string{"List-Unsubscribe": "<https://attacker.example.com>"}},
+		"list unsubscribe post": {headers: map[string]string{"List-Unsubscribe-Post": "List-Unsubscribe=One-Click"}},
+		"invalid name":          {headers: map[string]string{"X Tidepool": "abc"}},
+		"header injection":      {headers: map[string]string{"X-Tidepool-Trace": "abc\r\nBcc: attacker@example.com"}},
+		"duplicate header":      {headers: map[string]string{"X-Tidepool-Trace": "abc", "x-tidepool-trace": "def"}},
+		"no custom headers":     {valid: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := mailer.ValidateHeaders(test.headers)
+			if test.valid && err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			}
+			if !test.valid && !errors.Is(err, mailer.ErrInvalidHeader) {
+				t.Fatalf(`Error is "%v", but should be "%s"`, err, mailer.ErrInvalidHeader)
+			}
+		})
+	}
+}
+
+func Test_NewMessage_From(t *testing.T) {
+	msg, err := mailer.NewMessage(&mailer.Email{
+		From:       "Tidepool Clinics <clinics@tidepool.org>",
+		Recipients: []string{"clinician@example.com"},
+		Subject:    "Subject",
+		Body:       "<p>Body</p>",
+	}, "noreply@tidepool.org", "Tidepool")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	if msg.Sender != "clinics@tidepool.org" {
+		t.Errorf(`Sender is "%s", but should be "clinics@tidepool.org"`, msg.Sender)
+	}
+	if !strings.Contains(string(msg.Data), `From: "Tidepool Clinics" <clinics@tidepool.org>`) {
+		t.Errorf(`Message should be from clinics@tidepool.org, got %s`, msg.Data)
+	}
+}
+
+func Test_NewMessage_InlineAttachment(t *testing.T) {
+	msg, err := mailer.NewMessage(&mailer.Email{
+		Recipients: []string{"patient@example.com"},
+		Subject:    "Subject",
+		Body:       `<img src="cid:logo.png">`,
+		Attachments: []mailer.Attachment{
+			{ContentType: "image/png", Data: "iVBORw0KGgo=", Filename: "logo.png", Disposition: mailer.DispositionInline},
+			{ContentType: "text/csv", Data: "YSxiCg==", Filename: "report.csv"},
+		},
+	}, "sender@tidepool.org", "Tidepool")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	data := string(msg.Data)
+	for _, expected := range []string{
+		"Content-Type: multipart/mixed",
+		"Content-Type: multipart/related",
+		"Content-ID: <logo.png>",
+		`Content-Disposition: inline; filename="logo.png"`,
+		`Content-Disposition: attachment; filename="report.csv"`,
+	} {
+		if !strings.Contains(data, expected) {
+			t.Errorf(`Message should contain %q, got %s`, expected, data)
+		}
+	}
+	if count := strings.Count(data, "Content-Type: image/png"); count != 1 {
+		t.Errorf(`Message contains %d image/png content types, but should contain 1`, count)
+	}
+}
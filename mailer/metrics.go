@@ -1,9 +1,18 @@
 package mailer
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var (
-	errorCounter = createErrorCounter()
+	errorCounter     = createErrorCounter()
+	retryCounter     = createRetryCounter()
+	attemptHistogram = createAttemptHistogram()
+	deliveryCounter  = createDeliveryCounter()
+	failoverCounter  = createFailoverCounter()
+	breakerGauge     = createBreakerGauge()
 )
 
 func createErrorCounter() *prometheus.CounterVec {
@@ -20,6 +29,101 @@ func createErrorCounter() *prometheus.CounterVec {
 	return counter
 }
 
+func createRetryCounter() *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "backend_retries",
+		},
+		[]string{"code", "backend"},
+	)
+
+	prometheus.MustRegister(counter)
+	return counter
+}
+
+func createAttemptHistogram() *prometheus.HistogramVec {
+	histogram := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "send_attempts",
+			Buckets:   prometheus.LinearBuckets(1, 1, 10),
+		},
+		[]string{"backend", "success"},
+	)
+
+	prometheus.MustRegister(histogram)
+	return histogram
+}
+
+func createDeliveryCounter() *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "delivered_emails",
+		},
+		[]string{"backend"},
+	)
+
+	prometheus.MustRegister(counter)
+	return counter
+}
+
+func createFailoverCounter() *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "backend_failovers",
+		},
+		[]string{"backend"},
+	)
+
+	prometheus.MustRegister(counter)
+	return counter
+}
+
+func createBreakerGauge() *prometheus.GaugeVec {
+	gauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "circuit_breaker_open",
+		},
+		[]string{"backend"},
+	)
+
+	prometheus.MustRegister(gauge)
+	return gauge
+}
+
 func ObserveError(code string, backend string) {
 	errorCounter.WithLabelValues(code, backend).Inc()
-}
\ No newline at end of file
+}
+
+func ObserveRetry(backend string, code string) {
+	retryCounter.WithLabelValues(code, backend).Inc()
+}
+
+func ObserveAttempts(backend string, attempts int, success bool) {
+	attemptHistogram.WithLabelValues(backend, strconv.FormatBool(success)).Observe(float64(attempts))
+}
+
+func ObserveDelivery(backend string) {
+	deliveryCounter.WithLabelValues(backend).Inc()
+}
+
+func ObserveFailover(backend string) {
+	failoverCounter.WithLabelValues(backend).Inc()
+}
+
+func ObserveCircuitBreaker(backend string, open bool) {
+	value := 0.0
+	if open {
+		value = 1
+	}
+	breakerGauge.WithLabelValues(backend).Set(value)
+}
@@ -0,0 +1,139 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// retryableErrorCodes are the transient error codes of each backend which are worth retrying
+var retryableErrorCodes = map[string]map[string]bool{
+	// The codes of the SESv2 api, and the generic codes of the AWS services returned with 5xx responses
+	SESMailerBackendID: {
+		"TooManyRequestsException":    true,
+		"LimitExceededException":      true,
+		"ThrottlingException":         true,
+		"InternalFailure":             true,
+		"InternalServerError":         true,
+		"ServiceUnavailable":          true,
+		"ServiceUnavailableException": true,
+		"RequestTimeout":              true,
+		"RequestTimeoutException":     true,
+	},
+	SMTPMailerBackendID: {
+		"421": true, // Service not available, closing transmission channel
+		"450": true, // Mailbox unavailable
+		"451": true, // Local error in processing
+		"452": true, // Insufficient system storage
+		"454": true, // Temporary authentication failure
+	},
+}
+
+type RetryConfig struct {
+	MaxAttempts  int           `envconfig:"TIDEPOOL_MAILER_RETRY_MAX_ATTEMPTS" default:"4" validate:"min=1"`
+	InitialDelay time.Duration `envconfig:"TIDEPOOL_MAILER_RETRY_INITIAL_DELAY" default:"500ms"`
+	MaxDelay     time.Duration `envconfig:"TIDEPOOL_MAILER_RETRY_MAX_DELAY" default:"10s"`
+}
+
+// RetryingMailer retries transient backend errors with jittered exponential backoff. It never
+// waits past the deadline of the context. Errors are wrapped in an AttemptsError.
+type RetryingMailer struct {
+	backend  string
+	cfg      *RetryConfig
+	delegate Mailer
+	logger   *zap.SugaredLogger
+}
+
+// Compile time interface check
+var _ Mailer = &RetryingMailer{}
+
+type RetryingMailerParams struct {
+	Backend  string
+	Cfg      *RetryConfig
+	Delegate Mailer
+	Logger   *zap.SugaredLogger
+}
+
+func NewRetryingMailer(params *RetryingMailerParams) *RetryingMailer {
+	return &RetryingMailer{
+		backend:  params.Backend,
+		cfg:      params.Cfg,
+		delegate: params.Delegate,
+		logger:   params.Logger.With(zap.String("backend", params.Backend)),
+	}
+}
+
+func (r *RetryingMailer) Send(ctx context.Context, email *Email) (string, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	attempt := 1
+	id, err := r.delegate.Send(ctx, email)
+	for ; err != nil && attempt < r.cfg.MaxAttempts && IsRetryable(err); attempt++ {
+		delay := r.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			r.logger.Warnw("Not retrying because the deadline would be exceeded", "attempt", attempt, "error", err)
+			break
+		}
+
+		r.logger.Infow("Retrying after transient error", "attempt", attempt, "delay", delay, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			ObserveAttempts(r.backend, attempt, false)
+			return "", &AttemptsError{Attempts: attempt, Err: err}
+		case <-timer.C:
+		}
+
+		ObserveRetry(r.backend, errorCode(err))
+		id, err = r.delegate.Send(ctx, email)
+	}
+
+	ObserveAttempts(r.backend, attempt, err == nil)
+	if err != nil {
+		return "", &AttemptsError{Attempts: attempt, Err: err}
+	}
+	return id, nil
+}
+
+// backoff returns the delay before the next attempt. The delay doubles after each attempt and
+// half of it is randomized to spread out retries of concurrent sends.
+func (r *RetryingMailer) backoff(attempt int) time.Duration {
+	delay := r.cfg.InitialDelay << (attempt - 1)
+	if delay > r.cfg.MaxDelay || delay <= 0 {
+		delay = r.cfg.MaxDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + rand.N(delay/2)
+}
+
+// IsRetryable returns true if the error is transient and sending the email again may succeed
+func IsRetryable(err error) bool {
+	if err == nil || IsPermanent(err) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) && retryableErrorCodes[backendErr.Backend][backendErr.Code] {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func errorCode(err error) string {
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) {
+		return backendErr.Code
+	}
+	return UnknownErrorCode
+}
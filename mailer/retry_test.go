@@ -0,0 +1,106 @@
+package mailer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+type sequenceMailer struct {
+	errs  []error
+	calls int
+}
+
+func (s *sequenceMailer) Send(ctx context.Context, email *mailer.Email) (string, error) {
+	s.calls++
+	if len(s.errs) == 0 {
+		return "message-id", nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return "", err
+}
+
+var (
+	throttlingErr = &mailer.BackendError{Backend: mailer.SESMailerBackendID, Code: "TooManyRequestsException", Err: errors.New("rate exceeded")}
+	rejectedErr   = &mailer.BackendError{Backend: mailer.SESMailerBackendID, Code: "MessageRejected", Permanent: true, Err: errors.New("rejected")}
+)
+
+func newTestRetryingMailer(delegate mailer.Mailer, delay time.Duration) *mailer.RetryingMailer {
+	return mailer.NewRetryingMailer(&mailer.RetryingMailerParams{
+		Backend: mailer.SESMailerBackendID,
+		Cfg: &mailer.RetryConfig{
+			MaxAttempts:  3,
+			InitialDelay: delay,
+			MaxDelay:     delay * 4,
+		},
+		Delegate: delegate,
+		Logger:   zap.NewNop().Sugar(),
+	})
+}
+
+func Test_RetryingMailer_Send_RetriesTransientErrors(t *testing.T) {
+	delegate := &sequenceMailer{errs: []error{throttlingErr, throttlingErr}}
+	m := newTestRetryingMailer(delegate, time.Millisecond)
+
+	id, err := m.Send(context.Background(), &mailer.Email{})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if id != "message-id" {
+		t.Fatalf(`Message id is "%s", but should be "message-id"`, id)
+	}
+	if delegate.calls != 3 {
+		t.Fatalf(`Expected 3 attempts, got %v`, delegate.calls)
+	}
+}
+
+func Test_RetryingMailer_Send_StopsAfterMaxAttempts(t *testing.T) {
+	delegate := &sequenceMailer{errs: []error{throttlingErr, throttlingErr, throttlingErr, throttlingErr}}
+	m := newTestRetryingMailer(delegate, time.Millisecond)
+
+	_, err := m.Send(context.Background(), &mailer.Email{})
+	if !errors.Is(err, throttlingErr) {
+		t.Fatalf(`Error is "%s", but should be "%s"`, err, throttlingErr)
+	}
+	if delegate.calls != 3 {
+		t.Fatalf(`Expected 3 attempts, got %v`, delegate.calls)
+	}
+	if attempts := mailer.Attempts(err); attempts != 3 {
+		t.Errorf(`Attempts are %v, but should be 3`, attempts)
+	}
+}
+
+func Test_RetryingMailer_Send_DoesNotRetryPermanentErrors(t *testing.T) {
+	delegate := &sequenceMailer{errs: []error{rejectedErr}}
+	m := newTestRetryingMailer(delegate, time.Millisecond)
+
+	if _, err := m.Send(context.Background(), &mailer.Email{}); !errors.Is(err, rejectedErr) {
+		t.Fatalf(`Error is "%s", but should be "%s"`, err, rejectedErr)
+	}
+	if delegate.calls != 1 {
+		t.Fatalf(`Expected a single attempt, got %v`, delegate.calls)
+	}
+}
+
+func Test_RetryingMailer_Send_RespectsDeadline(t *testing.T) {
+	delegate := &sequenceMailer{errs: []error{throttlingErr, throttlingErr}}
+	m := newTestRetryingMailer(delegate, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := m.Send(ctx, &mailer.Email{}); !errors.Is(err, throttlingErr) {
+		t.Fatalf(`Error is "%s", but should be "%s"`, err, throttlingErr)
+	}
+	if delegate.calls != 1 {
+		t.Fatalf(`Expected a single attempt, got %v`, delegate.calls)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf(`Send should return immediately when the backoff exceeds the deadline`)
+	}
+}
@@ -0,0 +1,74 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/kelseyhightower/envconfig"
+)
+
+var ErrSenderNotAllowed = errors.New("sender is not allowed")
+
+type SenderAllowListConfig struct {
+	SenderAddress string `envconfig:"TIDEPOOL_EMAIL_SENDER_ADDRESS" default:"noreply@tidepool.org" validate:"email"`
+	// AllowedSenders are the addresses which can be used as the sender of an email in addition to
+	// the default sender address. Entries starting with @ allow all addresses of the domain.
+	AllowedSenders []string `envconfig:"TIDEPOOL_EMAIL_ALLOWED_SENDERS"`
+}
+
+// SenderAllowList restricts the sender identities which can be used by templates
+type SenderAllowList struct {
+	addresses map[string]bool
+	domains   map[string]bool
+}
+
+func NewSenderAllowList(validate *validator.Validate) (*SenderAllowList, error) {
+	cfg := &SenderAllowListConfig{}
+	if err := envconfig.Process("", cfg); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(cfg); err != nil {
+		return nil, err
+	}
+	return NewSenderAllowListFromConfig(cfg)
+}
+
+func NewSenderAllowListFromConfig(cfg *SenderAllowListConfig) (*SenderAllowList, error) {
+	allowList := &SenderAllowList{
+		addresses: map[string]bool{strings.ToLower(cfg.SenderAddress): true},
+		domains:   make(map[string]bool),
+	}
+	for _, sender := range cfg.AllowedSenders {
+		sender = strings.ToLower(strings.TrimSpace(sender))
+		if domain, ok := strings.CutPrefix(sender, "@"); ok {
+			if domain == "" || strings.Contains(domain, "@") {
+				return nil, fmt.Errorf("invalid allowed sender domain %s", sender)
+			}
+			allowList.domains[domain] = true
+			continue
+		}
+		if _, err := mail.ParseAddress(sender); err != nil {
+			return nil, fmt.Errorf("invalid allowed sender %s: %w", sender, err)
+		}
+		allowList.addresses[sender] = true
+	}
+	return allowList, nil
+}
+
+// Validate returns an error if the address of the sender (e.g. "Tidepool <noreply@tidepool.org>") is not allowed
+func (s *SenderAllowList) Validate(sender string) error {
+	address, err := mail.ParseAddress(sender)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrSenderNotAllowed, sender, err)
+	}
+
+	email := strings.ToLower(address.Address)
+	_, domain, _ := strings.Cut(email, "@")
+	if !s.addresses[email] && !s.domains[domain] {
+		return fmt.Errorf("%w: %s", ErrSenderNotAllowed, address.Address)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package mailer_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tidepool-org/mailer/mailer"
+)
+
+func Test_SenderAllowList_Validate(t *testing.T) {
+	allowList, err := mailer.NewSenderAllowListFromConfig(&mailer.SenderAllowListConfig{
+		SenderAddress:  "noreply@tidepool.org",
+		AllowedSenders: []string{"clinics@tidepool.org", "@research.tidepool.org"},
+	})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	tests := map[string]bool{
+		"noreply@tidepool.org":                                true,
+		"Tidepool Clinics <Clinics@Tidepool.org>":             true,
+		"Tidepool Research <donations@research.tidepool.org>": true,
+		"research@tidepool.org":                               false,
+		"Tidepool <noreply@tidepool.org.example.com>":         false,
+		"not an address":                                      false,
+	}
+	for sender, allowed := range tests {
+		err := allowList.Validate(sender)
+		if allowed && err != nil {
+			t.Errorf(`Error for sender "%s" is "%s", but should be nil`, sender, err)
+		}
+		if !allowed && !errors.Is(err, mailer.ErrSenderNotAllowed) {
+			t.Errorf(`Error for sender "%s" is "%v", but should be "%s"`, sender, err, mailer.ErrSenderNotAllowed)
+		}
+	}
+}
+
+func Test_NewSenderAllowListFromConfig_InvalidEntry(t *testing.T) {
+	_, err := mailer.NewSenderAllowListFromConfig(&mailer.SenderAllowListConfig{
+		SenderAddress:  "noreply@tidepool.org",
+		AllowedSenders: []string{"not an address"},
+	})
+	if err == nil {
+		t.Fatal("Error should not be nil")
+	}
+}
@@ -1,32 +1,41 @@
 package mailer
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
-	"fmt"
-	"io"
+	"errors"
+	"maps"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/aws/smithy-go"
 	"go.uber.org/zap"
-	"golang.org/x/net/idna"
-
-	"gopkg.in/gomail.v2"
 )
 
 const (
 	SESMailerBackendID = "ses"
 	UnknownErrorCode   = "unknown"
+
+	sesNotFoundErrorCode      = "NotFoundException"
+	sesAlreadyExistsErrorCode = "AlreadyExistsException"
 )
 
+// sesPermanentErrorCodes are the errors returned when SES rejects the message itself
+var sesPermanentErrorCodes = map[string]bool{
+	"MessageRejected":                    true,
+	"MailFromDomainNotVerifiedException": true,
+	"BadRequestException":                true,
+	sesNotFoundErrorCode:                 true,
+}
+
 type SESMailer struct {
 	cfg    *SESMailerConfig
 	logger *zap.SugaredLogger
-	svc    *ses.SES
+	svc    *sesv2.Client
 }
 
 // Compile time interface check
@@ -36,6 +45,12 @@ type SESMailerConfig struct {
 	SenderName    string `envconfig:"TIDEPOOL_EMAIL_SENDER_NAME" default:"Tidepool"`
 	SenderAddress string `envconfig:"TIDEPOOL_EMAIL_SENDER_ADDRESS" default:"noreply@tidepool.org" validate:"email"`
 	Region        string `envconfig:"TIDEPOOL_SES_REGION" default:"us-west-2" validate:"required"`
+	// Endpoint is optional, it overrides the SES endpoint of the region (e.g. a local fake) if it's set
+	Endpoint string `envconfig:"TIDEPOOL_SES_ENDPOINT" validate:"omitempty,url"`
+	// ConfigurationSet is optional, it's used when the email doesn't specify a configuration set
+	ConfigurationSet string `envconfig:"TIDEPOOL_SES_CONFIGURATION_SET"`
+	// Environment is optional, it's added as the environment tag of every email if it's set
+	Environment string `envconfig:"TIDEPOOL_ENV"`
 }
 
 type SESMailerParams struct {
@@ -43,10 +58,29 @@ type SESMailerParams struct {
 	Logger *zap.SugaredLogger
 }
 
+// Contact is a recipient in an SES contact list. Topics maps the topic names to the subscription
+// status of the contact.
+type Contact struct {
+	Email          string
+	Topics         map[string]bool
+	UnsubscribeAll bool
+}
+
+// SuppressedDestination is an address in the SES account-level suppression list
+type SuppressedDestination struct {
+	Email          string
+	Reason         string
+	LastUpdateTime time.Time
+}
+
 func NewSESMailer(params *SESMailerParams) (*SESMailer, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(params.Cfg.Region)},
-	)
+	if params.Cfg.ConfigurationSet != "" {
+		if err := ValidateConfigurationSet(params.Cfg.ConfigurationSet); err != nil {
+			return nil, err
+		}
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(params.Cfg.Region))
 	if err != nil {
 		return nil, err
 	}
@@ -54,107 +88,211 @@ func NewSESMailer(params *SESMailerParams) (*SESMailer, error) {
 	return &SESMailer{
 		cfg:    params.Cfg,
 		logger: params.Logger.With(zap.String("backend", SESMailerBackendID)),
-		svc:    ses.New(sess),
+		svc: sesv2.NewFromConfig(awsConfig, func(o *sesv2.Options) {
+			if params.Cfg.Endpoint != "" {
+				o.BaseEndpoint = aws.String(params.Cfg.Endpoint)
+			}
+		}),
 	}, nil
 }
 
-func (s *SESMailer) Send(ctx context.Context, email *Email) error {
+func (s *SESMailer) Send(ctx context.Context, email *Email) (string, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
 
-	s.logger.Infof("Sending to recipient '%s', with CC '%s'", strings.Join(email.Recipients, ", "), strings.Join(email.Cc, ", "))
+	s.logger.Infof("Sending to recipient '%s', with CC '%s' and %d BCC", strings.Join(email.Recipients, ", "), strings.Join(email.Cc, ", "), len(email.Bcc))
 
 	input, err := s.CreateSendEmailInput(email)
 	if err != nil {
 		s.logger.Errorw("Error while creating email input", "error", err, "recipients", email.Recipients, "cc", email.Cc)
-		return err
+		return "", NewPermanentError(err)
 	}
-	res, err := s.svc.SendRawEmailWithContext(ctx, input)
+	// The SDK retryer is disabled, because transient errors are retried by the RetryingMailer
+	res, err := s.svc.SendEmail(ctx, input, func(o *sesv2.Options) {
+		o.RetryMaxAttempts = 1
+	})
 	if err != nil {
-		code := UnknownErrorCode
-		if awsError, ok := err.(awserr.Error); ok {
-			code = awsError.Code()
-		}
-
-		ObserveError(code, SESMailerBackendID)
-		s.logger.Errorw("Error while sending email", "code", code, "error", err)
-		return err
+		backendErr := newSESBackendError(err)
+		ObserveError(backendErr.Code, SESMailerBackendID)
+		s.logger.Errorw("Error while sending email", "code", backendErr.Code, "error", err)
+		return "", backendErr
 	}
 
-	s.logger.Infow("Successfully sent message", "id", *res.MessageId)
-	return nil
-}
-
-func FormatSender(name, address string) string {
-	if name == "" {
-		return address
-	}
-	return fmt.Sprintf("%s <%s>", name, address)
+	s.logger.Infow("Successfully sent message", "id", aws.ToString(res.MessageId))
+	return aws.ToString(res.MessageId), nil
 }
 
-func (s *SESMailer) CreateSendEmailInput(email *Email) (*ses.SendRawEmailInput, error) {
-	toAddresses, err := addresses(email.Recipients)
-	if err != nil {
-		return nil, err
-	}
-	ccAddresses, err := addresses(email.Cc)
+func (s *SESMailer) CreateSendEmailInput(email *Email) (*sesv2.SendEmailInput, error) {
+	msg, err := NewMessage(email, s.cfg.SenderAddress, s.cfg.SenderName)
 	if err != nil {
 		return nil, err
 	}
 
-	msg := gomail.NewMessage()
+	// The recipients of raw messages are taken from the destination, so bcc recipients
+	// are only added to the envelope
+	input := &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(msg.Sender),
+		Destination:      &types.Destination{ToAddresses: msg.Destinations},
+		Content:          &types.EmailContent{Raw: &types.RawMessage{Data: msg.Data}},
+	}
 
-	var recipients []*string
-	for _, r := range toAddresses {
-		recipients = append(recipients, &r)
+	configurationSet := s.cfg.ConfigurationSet
+	if email.ConfigurationSet != "" {
+		configurationSet = email.ConfigurationSet
 	}
-	for _, r := range ccAddresses {
-		recipients = append(recipients, &r)
+	if configurationSet != "" {
+		if err := ValidateConfigurationSet(configurationSet); err != nil {
+			return nil, err
+		}
+		input.ConfigurationSetName = aws.String(configurationSet)
 	}
 
-	msg.SetHeader("To", email.Recipients...)
-	msg.SetAddressHeader("From", s.cfg.SenderAddress, s.cfg.SenderName)
-	msg.SetHeader("Subject", email.Subject)
-	msg.SetBody("text/html", email.Body)
-	if len(email.Cc) > 0 {
-		msg.SetHeader("cc", ccAddresses...)
+	if email.ListManagement != nil {
+		input.ListManagementOptions = &types.ListManagementOptions{
+			ContactListName: aws.String(email.ListManagement.ContactList),
+		}
+		if email.ListManagement.Topic != "" {
+			input.ListManagementOptions.TopicName = aws.String(email.ListManagement.Topic)
+		}
 	}
 
-	for _, attachment := range email.Attachments {
+	tags := maps.Clone(email.Tags)
+	if environment := SanitizeTagValue(s.cfg.Environment); environment != "" {
+		if tags == nil {
+			tags = make(map[string]string, 1)
+		}
+		tags[TagEnvironment] = environment
+	}
+	if err := ValidateTags(tags); err != nil {
+		return nil, err
+	}
+	for _, name := range slices.Sorted(maps.Keys(tags)) {
+		input.EmailTags = append(input.EmailTags, types.MessageTag{Name: aws.String(name), Value: aws.String(tags[name])})
+	}
 
-		msg.Attach(attachment.Filename, gomail.SetCopyFunc(func(writer io.Writer) error {
-			reader := base64.NewDecoder(base64.StdEncoding, strings.NewReader(attachment.Data))
-			_, err := io.Copy(writer, reader)
-			return err
-		}), gomail.SetHeader(map[string][]string{
-			"content-type": {attachment.ContentType},
-		}))
+	return input, nil
+}
+
+// PutContact adds the contact to the contact list or updates its topic preferences if it already exists
+func (s *SESMailer) PutContact(ctx context.Context, contactList string, contact Contact) error {
+	var preferences []types.TopicPreference
+	for _, topic := range slices.Sorted(maps.Keys(contact.Topics)) {
+		status := types.SubscriptionStatusOptOut
+		if contact.Topics[topic] {
+			status = types.SubscriptionStatusOptIn
+		}
+		preferences = append(preferences, types.TopicPreference{TopicName: aws.String(topic), SubscriptionStatus: status})
 	}
 
-	// create a new buffer to add raw data
-	var emailRaw bytes.Buffer
-	if _, err = msg.WriteTo(&emailRaw); err != nil {
-		return nil, err
+	_, err := s.svc.CreateContact(ctx, &sesv2.CreateContactInput{
+		ContactListName:  aws.String(contactList),
+		EmailAddress:     aws.String(contact.Email),
+		TopicPreferences: preferences,
+		UnsubscribeAll:   contact.UnsubscribeAll,
+	})
+	if sesErrorCode(err) == sesAlreadyExistsErrorCode {
+		_, err = s.svc.UpdateContact(ctx, &sesv2.UpdateContactInput{
+			ContactListName:  aws.String(contactList),
+			EmailAddress:     aws.String(contact.Email),
+			TopicPreferences: preferences,
+			UnsubscribeAll:   contact.UnsubscribeAll,
+		})
+	}
+	if err != nil {
+		return newSESBackendError(err)
 	}
+	return nil
+}
 
-	message := ses.RawMessage{Data: emailRaw.Bytes()}
+// DeleteContact removes the contact from the contact list. It doesn't fail if the contact doesn't exist.
+func (s *SESMailer) DeleteContact(ctx context.Context, contactList string, email string) error {
+	_, err := s.svc.DeleteContact(ctx, &sesv2.DeleteContactInput{
+		ContactListName: aws.String(contactList),
+		EmailAddress:    aws.String(email),
+	})
+	if err != nil && sesErrorCode(err) != sesNotFoundErrorCode {
+		return newSESBackendError(err)
+	}
+	return nil
+}
+
+// GetSuppressedDestination returns nil if the address is not in the account-level suppression list
+func (s *SESMailer) GetSuppressedDestination(ctx context.Context, email string) (*SuppressedDestination, error) {
+	res, err := s.svc.GetSuppressedDestination(ctx, &sesv2.GetSuppressedDestinationInput{EmailAddress: aws.String(email)})
+	if sesErrorCode(err) == sesNotFoundErrorCode {
+		return nil, nil
+	} else if err != nil {
+		return nil, newSESBackendError(err)
+	}
 
-	return &ses.SendRawEmailInput{
-		Source:       &s.cfg.SenderAddress,
-		Destinations: recipients,
-		RawMessage:   &message,
+	return &SuppressedDestination{
+		Email:          aws.ToString(res.SuppressedDestination.EmailAddress),
+		Reason:         string(res.SuppressedDestination.Reason),
+		LastUpdateTime: aws.ToTime(res.SuppressedDestination.LastUpdateTime),
 	}, nil
 }
 
-func addresses(emails []string) ([]string, error) {
-	addr := make([]string, 0, len(emails))
-	for _, recipient := range emails {
-		escapedRecipient, err := idna.ToASCII(recipient)
+// ListSuppressedDestinations returns all addresses in the account-level suppression list
+func (s *SESMailer) ListSuppressedDestinations(ctx context.Context) ([]SuppressedDestination, error) {
+	var destinations []SuppressedDestination
+	paginator := sesv2.NewListSuppressedDestinationsPaginator(s.svc, &sesv2.ListSuppressedDestinationsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("unable to Punycode email: %w", err)
+			return nil, newSESBackendError(err)
 		}
-		addr = append(addr, escapedRecipient)
+		for _, summary := range page.SuppressedDestinationSummaries {
+			destinations = append(destinations, SuppressedDestination{
+				Email:          aws.ToString(summary.EmailAddress),
+				Reason:         string(summary.Reason),
+				LastUpdateTime: aws.ToTime(summary.LastUpdateTime),
+			})
+		}
+	}
+	return destinations, nil
+}
+
+// PutSuppressedDestination adds the address to the account-level suppression list. The reason is
+// either BOUNCE or COMPLAINT.
+func (s *SESMailer) PutSuppressedDestination(ctx context.Context, email string, reason string) error {
+	_, err := s.svc.PutSuppressedDestination(ctx, &sesv2.PutSuppressedDestinationInput{
+		EmailAddress: aws.String(email),
+		Reason:       types.SuppressionListReason(reason),
+	})
+	if err != nil {
+		return newSESBackendError(err)
+	}
+	return nil
+}
+
+// DeleteSuppressedDestination removes the address from the account-level suppression list. It doesn't
+// fail if the address is not suppressed.
+func (s *SESMailer) DeleteSuppressedDestination(ctx context.Context, email string) error {
+	_, err := s.svc.DeleteSuppressedDestination(ctx, &sesv2.DeleteSuppressedDestinationInput{EmailAddress: aws.String(email)})
+	if err != nil && sesErrorCode(err) != sesNotFoundErrorCode {
+		return newSESBackendError(err)
+	}
+	return nil
+}
+
+func sesErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return UnknownErrorCode
+}
+
+func newSESBackendError(err error) *BackendError {
+	code := sesErrorCode(err)
+	return &BackendError{
+		Backend:   SESMailerBackendID,
+		Code:      code,
+		Permanent: sesPermanentErrorCodes[code],
+		Err:       err,
 	}
-	return addr, nil
 }
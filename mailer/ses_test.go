@@ -0,0 +1,359 @@
+package mailer_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+// fakeSES is a minimal stand-in for the SESv2 api which records the requests
+type fakeSES struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests map[string][]byte
+	// throttle is the number of sends which are rejected with 429 TooManyRequestsException
+	throttle int
+	sends    int
+	// suppressed maps the suppressed addresses to the reasons
+	suppressed map[string]string
+}
+
+func newFakeSES(t *testing.T) *fakeSES {
+	fake := &fakeSES{requests: make(map[string][]byte), suppressed: make(map[string]string)}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func (f *fakeSES) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.Method+" "+r.URL.Path] = body
+
+	const suppressionPath = "/v2/email/suppression/addresses"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v2/email/outbound-emails":
+		f.sends++
+		if f.sends <= f.throttle {
+			writeFakeSESError(w, http.StatusTooManyRequests, "TooManyRequestsException")
+			return
+		}
+		if strings.Contains(string(body), "rejected@example.com") {
+			writeFakeSESError(w, http.StatusBadRequest, "MessageRejected")
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"MessageId": "ses-message-id"})
+	case r.Method == http.MethodPost && r.URL.Path == "/v2/email/contact-lists/patients/contacts":
+		writeFakeSESError(w, http.StatusBadRequest, "AlreadyExistsException")
+	case r.Method == http.MethodPut && r.URL.Path == "/v2/email/contact-lists/patients/contacts/patient@example.com":
+		_ = json.NewEncoder(w).Encode(map[string]string{})
+	case r.Method == http.MethodPut && r.URL.Path == suppressionPath:
+		request := map[string]string{}
+		_ = json.Unmarshal(body, &request)
+		f.suppressed[request["EmailAddress"]] = request["Reason"]
+		_ = json.NewEncoder(w).Encode(map[string]string{})
+	case r.Method == http.MethodGet && r.URL.Path == suppressionPath:
+		var summaries []map[string]interface{}
+		for _, email := range slices.Sorted(maps.Keys(f.suppressed)) {
+			summaries = append(summaries, map[string]interface{}{"EmailAddress": email, "Reason": f.suppressed[email], "LastUpdateTime": 1790000000})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"SuppressedDestinationSummaries": summaries})
+	case strings.HasPrefix(r.URL.Path, suppressionPath+"/"):
+		email := strings.TrimPrefix(r.URL.Path, suppressionPath+"/")
+		reason, ok := f.suppressed[email]
+		if !ok {
+			writeFakeSESError(w, http.StatusNotFound, "NotFoundException")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.suppressed, email)
+			_ = json.NewEncoder(w).Encode(map[string]string{})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"SuppressedDestination": map[string]interface{}{"EmailAddress": email, "Reason": reason, "LastUpdateTime": 1790000000},
+		})
+	default:
+		writeFakeSESError(w, http.StatusNotFound, "NotFoundException")
+	}
+}
+
+func (f *fakeSES) request(key string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	request := map[string]interface{}{}
+	_ = json.Unmarshal(f.requests[key], &request)
+	return request
+}
+
+func writeFakeSESError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("X-Amzn-ErrorType", code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": code})
+}
+
+func newTestSESMailer(t *testing.T, cfg *mailer.SESMailerConfig) *mailer.SESMailer {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", "testdata/missing")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "testdata/missing")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	cfg.SenderName = "Tidepool"
+	cfg.SenderAddress = "noreply@tidepool.org"
+	cfg.Region = "us-west-2"
+	m, err := mailer.NewSESMailer(&mailer.SESMailerParams{Cfg: cfg, Logger: zap.NewNop().Sugar()})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	return m
+}
+
+func newTestSESEmail() *mailer.Email {
+	return &mailer.Email{
+		Recipients: []string{"patient@example.com"},
+		Subject:    "Subject",
+		Body:       "<p>Body</p>",
+		Tags:       map[string]string{mailer.TagTemplate: "clinic_invite", mailer.TagEventSource: "clinic"},
+	}
+}
+
+func Test_SESMailer_CreateSendEmailInput_ConfigurationSetAndTags(t *testing.T) {
+	m := newTestSESMailer(t, &mailer.SESMailerConfig{ConfigurationSet: "default-set", Environment: "qa1.development"})
+
+	input, err := m.CreateSendEmailInput(newTestSESEmail())
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if aws.ToString(input.ConfigurationSetName) != "default-set" {
+		t.Errorf(`Configuration set is "%s", but should be "default-set"`, aws.ToString(input.ConfigurationSetName))
+	}
+
+	expected := [][2]string{{"environment", "qa1_development"}, {"event_source", "clinic"}, {"template", "clinic_invite"}}
+	if len(input.EmailTags) != len(expected) {
+		t.Fatalf(`Tags are %v, but should be %v`, input.EmailTags, expected)
+	}
+	for i, tag := range input.EmailTags {
+		if aws.ToString(tag.Name) != expected[i][0] || aws.ToString(tag.Value) != expected[i][1] {
+			t.Errorf(`Tag is %s=%s, but should be %s=%s`, aws.ToString(tag.Name), aws.ToString(tag.Value), expected[i][0], expected[i][1])
+		}
+	}
+
+	email := newTestSESEmail()
+	email.ConfigurationSet = "marketing"
+	input, err = m.CreateSendEmailInput(email)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if aws.ToString(input.ConfigurationSetName) != "marketing" {
+		t.Errorf(`Configuration set is "%s", but should be "marketing"`, aws.ToString(input.ConfigurationSetName))
+	}
+}
+
+func Test_SESMailer_CreateSendEmailInput_WithoutConfigurationSet(t *testing.T) {
+	m := newTestSESMailer(t, &mailer.SESMailerConfig{})
+
+	input, err := m.CreateSendEmailInput(&mailer.Email{Recipients: []string{"patient@example.com"}, Subject: "Subject", Body: "<p>Body</p>"})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if input.ConfigurationSetName != nil || len(input.EmailTags) != 0 || input.ListManagementOptions != nil {
+		t.Errorf(`Expected no configuration set, list management and tags, got %v, %v and %v`, input.ConfigurationSetName, input.ListManagementOptions, input.EmailTags)
+	}
+}
+
+func Test_SESMailer_Send(t *testing.T) {
+	fake := newFakeSES(t)
+	m := newTestSESMailer(t, &mailer.SESMailerConfig{Endpoint: fake.server.URL})
+
+	email := newTestSESEmail()
+	email.Bcc = []string{"admin@example.com"}
+	email.ListManagement = &mailer.ListManagement{ContactList: "patients", Topic: "reminders"}
+	id, err := m.Send(context.Background(), email)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if id != "ses-message-id" {
+		t.Errorf(`Message id is "%s", but should be "ses-message-id"`, id)
+	}
+
+	request := fake.request("POST /v2/email/outbound-emails")
+	if request["FromEmailAddress"] != "noreply@tidepool.org" {
+		t.Errorf(`From is "%v", but should be "noreply@tidepool.org"`, request["FromEmailAddress"])
+	}
+	destination, _ := json.Marshal(request["Destination"])
+	if !strings.Contains(string(destination), "admin@example.com") {
+		t.Errorf(`Destination is %s, but should contain the bcc recipient`, destination)
+	}
+	listManagement, _ := json.Marshal(request["ListManagementOptions"])
+	if string(listManagement) != `{"ContactListName":"patients","TopicName":"reminders"}` {
+		t.Errorf(`List management options are %s, but should use the patients contact list`, listManagement)
+	}
+	content, _ := request["Content"].(map[string]interface{})
+	raw, _ := content["Raw"].(map[string]interface{})
+	data, err := base64.StdEncoding.DecodeString(raw["Data"].(string))
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if !strings.Contains(string(data), "Subject: Subject") || strings.Contains(string(data), "admin@example.com") {
+		t.Errorf(`Raw message should contain the subject, but not the bcc recipient, got %s`, data)
+	}
+}
+
+func Test_SESMailer_Send_Rejected(t *testing.T) {
+	fake := newFakeSES(t)
+	m := newTestSESMailer(t, &mailer.SESMailerConfig{Endpoint: fake.server.URL})
+
+	email := newTestSESEmail()
+	email.Recipients = []string{"rejected@example.com"}
+	_, err := m.Send(context.Background(), email)
+	var backendErr *mailer.BackendError
+	if !errors.As(err, &backendErr) || backendErr.Code != "MessageRejected" || !mailer.IsPermanent(err) {
+		t.Fatalf(`Error is "%v", but should be a permanent MessageRejected backend error`, err)
+	}
+}
+
+func Test_SESMailer_Send_Throttled(t *testing.T) {
+	fake := newFakeSES(t)
+	fake.throttle = 1
+	m := newTestSESMailer(t, &mailer.SESMailerConfig{Endpoint: fake.server.URL})
+
+	_, err := m.Send(context.Background(), newTestSESEmail())
+	var backendErr *mailer.BackendError
+	if !errors.As(err, &backendErr) || backendErr.Code != "TooManyRequestsException" || !mailer.IsRetryable(err) {
+		t.Fatalf(`Error is "%v", but should be a retryable TooManyRequestsException backend error`, err)
+	}
+	if fake.sends != 1 {
+		t.Fatalf(`Expected a single request, because the sdk retryer is disabled, got %v`, fake.sends)
+	}
+}
+
+func Test_SESMailer_Send_RetriesThrottling(t *testing.T) {
+	fake := newFakeSES(t)
+	fake.throttle = 2
+	m := newTestRetryingMailer(newTestSESMailer(t, &mailer.SESMailerConfig{Endpoint: fake.server.URL}), time.Millisecond)
+
+	id, err := m.Send(context.Background(), newTestSESEmail())
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if id != "ses-message-id" {
+		t.Fatalf(`Message id is "%s", but should be "ses-message-id"`, id)
+	}
+	if fake.sends != 3 {
+		t.Fatalf(`Expected 3 requests, got %v`, fake.sends)
+	}
+}
+
+func Test_SESMailer_PutContact(t *testing.T) {
+	fake := newFakeSES(t)
+	m := newTestSESMailer(t, &mailer.SESMailerConfig{Endpoint: fake.server.URL})
+
+	err := m.PutContact(context.Background(), "patients", mailer.Contact{Email: "patient@example.com", Topics: map[string]bool{"reminders": false}})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	preferences, _ := json.Marshal(fake.request("PUT /v2/email/contact-lists/patients/contacts/patient@example.com")["TopicPreferences"])
+	if string(preferences) != `[{"SubscriptionStatus":"OPT_OUT","TopicName":"reminders"}]` {
+		t.Errorf(`Topic preferences are %s, but existing contact should be opted out of reminders`, preferences)
+	}
+}
+
+func Test_SESMailer_SuppressedDestinations(t *testing.T) {
+	fake := newFakeSES(t)
+	m := newTestSESMailer(t, &mailer.SESMailerConfig{Endpoint: fake.server.URL})
+	ctx := context.Background()
+
+	if destination, err := m.GetSuppressedDestination(ctx, "patient@example.com"); err != nil || destination != nil {
+		t.Fatalf(`Expected no suppressed destination, got %v and "%v"`, destination, err)
+	}
+	if err := m.PutSuppressedDestination(ctx, "patient@example.com", "BOUNCE"); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	destination, err := m.GetSuppressedDestination(ctx, "patient@example.com")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if destination == nil || destination.Email != "patient@example.com" || destination.Reason != "BOUNCE" || destination.LastUpdateTime.IsZero() {
+		t.Fatalf(`Expected a bounce suppression, got %v`, destination)
+	}
+	destinations, err := m.ListSuppressedDestinations(ctx)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(destinations) != 1 || destinations[0].Email != "patient@example.com" {
+		t.Fatalf(`Expected a single suppressed destination, got %v`, destinations)
+	}
+	if err := m.DeleteSuppressedDestination(ctx, "patient@example.com"); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if err := m.DeleteSuppressedDestination(ctx, "patient@example.com"); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+}
+
+func Test_SESMailer_CreateSendEmailInput_InvalidTags(t *testing.T) {
+	m := newTestSESMailer(t, &mailer.SESMailerConfig{})
+
+	email := newTestSESEmail()
+	email.Tags["source"] = "tidepool.org/clinic"
+	if _, err := m.CreateSendEmailInput(email); !errors.Is(err, mailer.ErrInvalidTag) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, mailer.ErrInvalidTag)
+	}
+
+	email = newTestSESEmail()
+	email.ConfigurationSet = "invalid set"
+	if _, err := m.CreateSendEmailInput(email); !errors.Is(err, mailer.ErrInvalidConfigurationSet) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, mailer.ErrInvalidConfigurationSet)
+	}
+}
+
+func Test_ValidateTags(t *testing.T) {
+	tests := map[string]struct {
+		tags  map[string]string
+		valid bool
+	}{
+		"valid":           {tags: map[string]string{"template": "clinic_invite", "event-source": "Clinic-1"}, valid: true},
+		"empty name":      {tags: map[string]string{"": "value"}},
+		"empty value":     {tags: map[string]string{"template": ""}},
+		"invalid name":    {tags: map[string]string{"event source": "clinic"}},
+		"invalid value":   {tags: map[string]string{"template": "clinic.invite"}},
+		"non-ascii value": {tags: map[string]string{"template": "clínic"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := mailer.ValidateTags(test.tags)
+			if test.valid && err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			} else if !test.valid && !errors.Is(err, mailer.ErrInvalidTag) {
+				t.Fatalf(`Error is "%v", but should be "%s"`, err, mailer.ErrInvalidTag)
+			}
+		})
+	}
+}
+
+func Test_SanitizeTagValue(t *testing.T) {
+	if sanitized := mailer.SanitizeTagValue("https://tidepool.org/clinic"); sanitized != "https___tidepool_org_clinic" {
+		t.Errorf(`Sanitized value is "%s", but should be "https___tidepool_org_clinic"`, sanitized)
+	}
+	if err := mailer.ValidateTags(map[string]string{"value": mailer.SanitizeTagValue("clínic " + string(make([]byte, 300)))}); err != nil {
+		t.Errorf(`Error is "%s", but should be nil`, err)
+	}
+}
@@ -0,0 +1,369 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	SMTPMailerBackendID = "smtp"
+
+	SMTPSecurityNone     = "none"
+	SMTPSecuritySTARTTLS = "starttls"
+	SMTPSecurityTLS      = "tls"
+
+	SMTPAuthNone    = "none"
+	SMTPAuthPlain   = "plain"
+	SMTPAuthLogin   = "login"
+	SMTPAuthCRAMMD5 = "cram-md5"
+)
+
+type SMTPMailer struct {
+	cfg    *SMTPMailerConfig
+	dkim   *DKIMSigner
+	logger *zap.SugaredLogger
+	pool   *smtpPool
+}
+
+// Compile time interface check
+var _ Mailer = &SMTPMailer{}
+
+type SMTPMailerConfig struct {
+	SenderName         string        `envconfig:"TIDEPOOL_EMAIL_SENDER_NAME" default:"Tidepool"`
+	SenderAddress      string        `envconfig:"TIDEPOOL_EMAIL_SENDER_ADDRESS" default:"noreply@tidepool.org" validate:"email"`
+	Host               string        `envconfig:"TIDEPOOL_SMTP_HOST" default:"localhost" validate:"required"`
+	Port               uint16        `envconfig:"TIDEPOOL_SMTP_PORT" default:"587" validate:"required"`
+	Username           string        `envconfig:"TIDEPOOL_SMTP_USERNAME"`
+	Password           string        `envconfig:"TIDEPOOL_SMTP_PASSWORD"`
+	Security           string        `envconfig:"TIDEPOOL_SMTP_SECURITY" default:"starttls" validate:"oneof=none starttls tls"`
+	Auth               string        `envconfig:"TIDEPOOL_SMTP_AUTH" default:"none" validate:"oneof=none plain login cram-md5"`
+	InsecureSkipVerify bool          `envconfig:"TIDEPOOL_SMTP_INSECURE_SKIP_VERIFY" default:"false"`
+	LocalName          string        `envconfig:"TIDEPOOL_SMTP_LOCAL_NAME"`
+	PoolSize           int           `envconfig:"TIDEPOOL_SMTP_POOL_SIZE" default:"2" validate:"min=1"`
+	IdleTimeout        time.Duration `envconfig:"TIDEPOOL_SMTP_IDLE_TIMEOUT" default:"30s"`
+	DialTimeout        time.Duration `envconfig:"TIDEPOOL_SMTP_DIAL_TIMEOUT" default:"10s"`
+}
+
+type SMTPMailerParams struct {
+	Cfg *SMTPMailerConfig
+	// DKIM is optional, the messages are not signed if it's not set
+	DKIM   *DKIMSigner
+	Logger *zap.SugaredLogger
+}
+
+func NewSMTPMailer(params *SMTPMailerParams) (*SMTPMailer, error) {
+	if params.Cfg.Auth != SMTPAuthNone && params.Cfg.Username == "" {
+		return nil, fmt.Errorf("smtp username is required for %s authentication", params.Cfg.Auth)
+	}
+
+	return &SMTPMailer{
+		cfg:    params.Cfg,
+		dkim:   params.DKIM,
+		logger: params.Logger.With(zap.String("backend", SMTPMailerBackendID)),
+		pool: &smtpPool{
+			cfg:   params.Cfg,
+			idle:  make(chan *smtpConn, params.Cfg.PoolSize),
+			slots: make(chan struct{}, params.Cfg.PoolSize),
+		},
+	}, nil
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, email *Email) (string, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	s.logger.Infof("Sending to recipient '%s', with CC '%s' and %d BCC", strings.Join(email.Recipients, ", "), strings.Join(email.Cc, ", "), len(email.Bcc))
+
+	msg, err := NewMessage(email, s.cfg.SenderAddress, s.cfg.SenderName)
+	if err != nil {
+		s.logger.Errorw("Error while creating email message", "error", err, "recipients", email.Recipients, "cc", email.Cc)
+		return "", NewPermanentError(err)
+	}
+	if err := msg.Sign(s.dkim); err != nil {
+		s.logger.Errorw("Error while signing email message", "error", err)
+		return "", NewPermanentError(err)
+	}
+
+	conn, err := s.pool.get(ctx)
+	if err == nil {
+		if err = conn.send(ctx, msg); err != nil {
+			s.pool.discard(conn)
+		} else {
+			s.pool.put(conn)
+		}
+	}
+	if err != nil {
+		code := smtpErrorCode(err)
+		ObserveError(code, SMTPMailerBackendID)
+		s.logger.Errorw("Error while sending email", "code", code, "error", err)
+		return "", &BackendError{
+			Backend: SMTPMailerBackendID,
+			Code:    code,
+			// 5xx replies are permanent negative completions, 4xx replies are transient
+			Permanent: strings.HasPrefix(code, "5"),
+			Err:       err,
+		}
+	}
+
+	s.logger.Infow("Successfully sent message", "id", msg.ID)
+	return msg.ID, nil
+}
+
+func smtpErrorCode(err error) string {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return strconv.Itoa(protoErr.Code)
+	}
+	return UnknownErrorCode
+}
+
+// smtpPool opens up to PoolSize authenticated connections which are reused across sends. Each open
+// connection, idle or in use, holds a slot which is released when the connection is closed.
+type smtpPool struct {
+	cfg   *SMTPMailerConfig
+	idle  chan *smtpConn
+	slots chan struct{}
+}
+
+type smtpConn struct {
+	conn     net.Conn
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+func (p *smtpPool) get(ctx context.Context) (*smtpConn, error) {
+	for {
+		// Prefer idle connections over opening new ones
+		select {
+		case c := <-p.idle:
+			if p.reusable(ctx, c) {
+				return c, nil
+			}
+			continue
+		default:
+		}
+
+		select {
+		case c := <-p.idle:
+			if p.reusable(ctx, c) {
+				return c, nil
+			}
+		case p.slots <- struct{}{}:
+			c, err := p.dial(ctx)
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return c, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// reusable discards the idle connection if it expired or the server dropped it
+func (p *smtpPool) reusable(ctx context.Context, c *smtpConn) bool {
+	if time.Since(c.lastUsed) > p.cfg.IdleTimeout {
+		p.discard(c)
+		return false
+	}
+	c.setDeadline(ctx)
+	stop := c.closeOnDone(ctx)
+	err := c.client.Reset()
+	stop()
+	if err != nil {
+		p.discard(c)
+		return false
+	}
+	return true
+}
+
+func (p *smtpPool) put(c *smtpConn) {
+	c.lastUsed = time.Now()
+	select {
+	case p.idle <- c:
+	default:
+		p.discard(c)
+	}
+}
+
+// discard closes the connection and releases its slot
+func (p *smtpPool) discard(c *smtpConn) {
+	c.close()
+	<-p.slots
+}
+
+func (p *smtpPool) dial(ctx context.Context) (*smtpConn, error) {
+	addr := net.JoinHostPort(p.cfg.Host, strconv.Itoa(int(p.cfg.Port)))
+	tlsConfig := &tls.Config{
+		ServerName:         p.cfg.Host,
+		InsecureSkipVerify: p.cfg.InsecureSkipVerify,
+	}
+
+	dialer := &net.Dialer{Timeout: p.cfg.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	// Interrupt the greeting, the handshakes and the authentication if the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	if p.cfg.Security == SMTPSecurityTLS {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	client, err := smtp.NewClient(conn, p.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &smtpConn{conn: conn, client: client}
+
+	if p.cfg.LocalName != "" {
+		if err := client.Hello(p.cfg.LocalName); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	if p.cfg.Security == SMTPSecuritySTARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			c.close()
+			return nil, errors.New("smtp server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	if auth := p.auth(); auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			c.close()
+			return nil, errors.New("smtp server does not support AUTH")
+		}
+		if err := client.Auth(auth); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (p *smtpPool) auth() smtp.Auth {
+	switch p.cfg.Auth {
+	case SMTPAuthPlain:
+		return smtp.PlainAuth("", p.cfg.Username, p.cfg.Password, p.cfg.Host)
+	case SMTPAuthLogin:
+		return &loginAuth{username: p.cfg.Username, password: p.cfg.Password, host: p.cfg.Host}
+	case SMTPAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(p.cfg.Username, p.cfg.Password)
+	default:
+		return nil
+	}
+}
+
+func (c *smtpConn) send(ctx context.Context, msg *Message) error {
+	c.setDeadline(ctx)
+	defer c.conn.SetDeadline(time.Time{})
+	defer c.closeOnDone(ctx)()
+
+	if err := c.client.Mail(msg.Sender); err != nil {
+		return err
+	}
+	for _, destination := range msg.Destinations {
+		if err := c.client.Rcpt(destination); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (c *smtpConn) setDeadline(ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetDeadline(deadline)
+	}
+}
+
+// closeOnDone closes the connection when the context is cancelled, because cancellation doesn't interrupt
+// blocked reads and writes. The returned function stops watching the context.
+func (c *smtpConn) closeOnDone(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() {
+		_ = c.conn.Close()
+	})
+}
+
+func (c *smtpConn) close() {
+	if err := c.client.Quit(); err != nil {
+		_ = c.client.Close()
+	}
+}
+
+// loginAuth implements the LOGIN authentication mechanism which isn't supported by net/smtp
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Same restriction as smtp.PlainAuth - never send credentials over an unencrypted connection
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+	}
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
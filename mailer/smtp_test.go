@@ -0,0 +1,305 @@
+package mailer_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/mailer/mailer"
+	"go.uber.org/zap"
+)
+
+type receivedMessage struct {
+	auth       string
+	from       string
+	recipients []string
+	data       string
+}
+
+// fakeSMTPServer is a minimal plaintext SMTP server which records the messages it receives
+type fakeSMTPServer struct {
+	listener    net.Listener
+	mu          sync.Mutex
+	connections int
+	open        int
+	maxOpen     int
+	messages    []receivedMessage
+	// stall makes the server stop replying after MAIL FROM, until the client closes the connection
+	stall bool
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	server := &fakeSMTPServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.connections++
+			server.open++
+			server.maxOpen = max(server.maxOpen, server.open)
+			server.mu.Unlock()
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (f *fakeSMTPServer) port() uint16 {
+	return uint16(f.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (f *fakeSMTPServer) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		f.mu.Lock()
+		f.open--
+		f.mu.Unlock()
+	}()
+	reader := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+	current := receivedMessage{}
+	auth := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch command {
+		case "EHLO":
+			reply("250-localhost", "250-AUTH PLAIN LOGIN", "250 8BITMIME")
+		case "AUTH":
+			parts := strings.Fields(line)
+			if parts[1] == "LOGIN" {
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				username, _ := reader.ReadString('\n')
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				password, _ := reader.ReadString('\n')
+				auth = "LOGIN " + strings.TrimSpace(username) + " " + strings.TrimSpace(password)
+			} else {
+				auth = line
+			}
+			reply("235 Authentication successful")
+		case "MAIL":
+			f.mu.Lock()
+			stall := f.stall
+			f.mu.Unlock()
+			if stall {
+				continue
+			}
+			current = receivedMessage{auth: auth, from: line[len("MAIL FROM:"):]}
+			reply("250 OK")
+		case "RCPT":
+			current.recipients = append(current.recipients, line[len("RCPT TO:"):])
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var data strings.Builder
+			for {
+				l, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			current.data = data.String()
+			f.mu.Lock()
+			f.messages = append(f.messages, current)
+			f.mu.Unlock()
+			reply("250 OK")
+		case "RSET", "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func newTestSMTPMailer(t *testing.T, server *fakeSMTPServer, auth string) *mailer.SMTPMailer {
+	m, err := mailer.NewSMTPMailer(&mailer.SMTPMailerParams{
+		Cfg: &mailer.SMTPMailerConfig{
+			SenderName:    "Tidepool",
+			SenderAddress: "noreply@tidepool.org",
+			Host:          "127.0.0.1",
+			Port:          server.port(),
+			Username:      "user",
+			Password:      "secret",
+			Security:      mailer.SMTPSecurityNone,
+			Auth:          auth,
+			PoolSize:      1,
+			IdleTimeout:   time.Minute,
+			DialTimeout:   time.Second,
+		},
+		Logger: zap.NewNop().Sugar(),
+	})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	return m
+}
+
+func Test_SMTPMailer_Send_ReusesPooledConnection(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	m := newTestSMTPMailer(t, server, mailer.SMTPAuthPlain)
+
+	for i := 0; i < 2; i++ {
+		email := &mailer.Email{
+			Recipients: []string{"patient@example.com"},
+			Cc:         []string{"clinic@example.com"},
+			Subject:    "Subject " + strconv.Itoa(i),
+			Body:       "<p>Hello</p>",
+		}
+		if _, err := m.Send(context.Background(), email); err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.connections != 1 {
+		t.Fatalf(`Expected a single connection, got %v`, server.connections)
+	}
+	if len(server.messages) != 2 {
+		t.Fatalf(`Expected 2 messages, got %v`, len(server.messages))
+	}
+
+	msg := server.messages[1]
+	expectedAuth := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+	if msg.auth != expectedAuth {
+		t.Errorf(`Auth is "%s", but should be "%s"`, msg.auth, expectedAuth)
+	}
+	if !strings.HasPrefix(msg.from, "<noreply@tidepool.org>") {
+		t.Errorf(`Sender is "%s", but should start with "<noreply@tidepool.org>"`, msg.from)
+	}
+	if strings.Join(msg.recipients, ",") != "<patient@example.com>,<clinic@example.com>" {
+		t.Errorf(`Unexpected recipients %v`, msg.recipients)
+	}
+	if !strings.Contains(msg.data, "Subject: Subject 1\r\n") {
+		t.Errorf(`Message doesn't contain the expected subject: %s`, msg.data)
+	}
+}
+
+func Test_SMTPMailer_Send_LoginAuth(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	m := newTestSMTPMailer(t, server, mailer.SMTPAuthLogin)
+
+	email := &mailer.Email{
+		Recipients: []string{"patient@example.com"},
+		Subject:    "Subject",
+		Body:       "<p>Hello</p>",
+		TextBody:   "Hello",
+	}
+	if _, err := m.Send(context.Background(), email); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	expectedAuth := "LOGIN " + base64.StdEncoding.EncodeToString([]byte("user")) + " " + base64.StdEncoding.EncodeToString([]byte("secret"))
+	if len(server.messages) != 1 || server.messages[0].auth != expectedAuth {
+		t.Fatalf(`Expected a single message authenticated with "%s", got %v`, expectedAuth, server.messages)
+	}
+	if !strings.Contains(server.messages[0].data, "Content-Type: multipart/alternative;") {
+		t.Errorf(`Message should contain a plain text alternative: %s`, server.messages[0].data)
+	}
+}
+
+func Test_SMTPMailer_Send_BoundsConnections(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	m := newTestSMTPMailer(t, server, mailer.SMTPAuthNone)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.Send(context.Background(), &mailer.Email{
+				Recipients: []string{"patient@example.com"},
+				Subject:    "Subject",
+				Body:       "<p>Hello</p>",
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.maxOpen != 1 {
+		t.Errorf(`Expected at most a single open connection, got %v`, server.maxOpen)
+	}
+	if len(server.messages) != 10 {
+		t.Errorf(`Expected 10 messages, got %v`, len(server.messages))
+	}
+}
+
+func Test_SMTPMailer_Send_Cancellation(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.stall = true
+	m := newTestSMTPMailer(t, server, mailer.SMTPAuthNone)
+
+	// The context has no deadline, so only the cancellation can interrupt the blocked read
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.Send(ctx, &mailer.Email{
+			Recipients: []string{"patient@example.com"},
+			Subject:    "Subject",
+			Body:       "<p>Hello</p>",
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Error should not be nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send should return when the context is cancelled")
+	}
+
+	// The connection was discarded, so another send can open a new one
+	server.mu.Lock()
+	server.stall = false
+	server.mu.Unlock()
+	if _, err := m.Send(context.Background(), &mailer.Email{Recipients: []string{"patient@example.com"}, Subject: "Subject", Body: "<p>Hello</p>"}); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+}
@@ -0,0 +1,71 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	TagTemplate    = "template"
+	TagEnvironment = "environment"
+	TagEventSource = "event_source"
+
+	maxTagLength              = 255
+	maxConfigurationSetLength = 64
+)
+
+var (
+	ErrInvalidTag              = errors.New("invalid tag")
+	ErrInvalidConfigurationSet = errors.New("invalid configuration set")
+)
+
+// ValidateTags checks that the tag names and values contain only ASCII letters, numbers, underscores
+// and dashes, and are at most 255 characters long, as required by SES
+func ValidateTags(tags map[string]string) error {
+	for name, value := range tags {
+		if name == "" || len(name) > maxTagLength || !isTagString(name) {
+			return fmt.Errorf("%w %q: name must be 1 to %d letters, numbers, underscores or dashes", ErrInvalidTag, name, maxTagLength)
+		}
+		if value == "" || len(value) > maxTagLength || !isTagString(value) {
+			return fmt.Errorf("%w %q: value must be 1 to %d letters, numbers, underscores or dashes", ErrInvalidTag, name, maxTagLength)
+		}
+	}
+	return nil
+}
+
+// ValidateConfigurationSet checks that the name is a valid SES configuration set name
+func ValidateConfigurationSet(name string) error {
+	if name == "" || len(name) > maxConfigurationSetLength || !isTagString(name) {
+		return fmt.Errorf("%w %q: name must be 1 to %d letters, numbers, underscores or dashes", ErrInvalidConfigurationSet, name, maxConfigurationSetLength)
+	}
+	return nil
+}
+
+// SanitizeTagValue replaces the characters which are not allowed in tag values with underscores and
+// truncates the value, so values which aren't controlled by the service (e.g. event sources) can be
+// used as tags. It returns an empty string if the value is empty.
+func SanitizeTagValue(value string) string {
+	sanitized := []byte(value)
+	if len(sanitized) > maxTagLength {
+		sanitized = sanitized[:maxTagLength]
+	}
+	for i, c := range sanitized {
+		if !isTagChar(c) {
+			sanitized[i] = '_'
+		}
+	}
+	return string(sanitized)
+}
+
+func isTagString(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if !isTagChar(value[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTagChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-'
+}
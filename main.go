@@ -11,6 +11,7 @@ import (
 	"github.com/tidepool-org/mailer/api"
 	"github.com/tidepool-org/mailer/consumer"
 	"github.com/tidepool-org/mailer/mailer"
+	"github.com/tidepool-org/mailer/notifications"
 	"github.com/tidepool-org/mailer/templates"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
@@ -19,9 +20,14 @@ import (
 )
 
 type Config struct {
-	Backend     mailer.Backend `envconfig:"TIDEPOOL_MAILER_BACKEND" default:"console" validate:"oneof=ses console"`
+	// Backend is either ses, smtp, file, memory or console, or an ordered failover chain, e.g. ses:us-west-2,ses:us-east-1,smtp
+	Backend     mailer.Backend `envconfig:"TIDEPOOL_MAILER_BACKEND" default:"console" validate:"required"`
 	LoggerLevel string         `envconfig:"TIDEPOOL_LOGGER_LEVEL" default:"debug" validate:"oneof=error warn info debug"`
 	ServerPort  uint16         `envconfig:"TIDEPOOL_SERVICE_PORT" default:"8080" validate:"required"`
+	// InternalPort serves the admin API, i.e. sending emails and managing the suppression list. It must not be exposed publicly.
+	InternalPort uint16 `envconfig:"TIDEPOOL_MAILER_INTERNAL_PORT" default:"8081" validate:"required,nefield=ServerPort"`
+	// TemplatesDir is optional, the templates are loaded from it and reloaded on change instead of using the embedded templates
+	TemplatesDir string `envconfig:"TIDEPOOL_MAILER_TEMPLATES_DIR"`
 }
 
 func provideValidator() *validator.Validate {
@@ -70,6 +76,99 @@ func provideLogger(cfg *Config, lifecycle fx.Lifecycle) (*zap.SugaredLogger, err
 	return logger, nil
 }
 
+// validateTemplateSenders rejects templates with a sender which is not in the allow list
+func validateTemplateSenders(senders *mailer.SenderAllowList) func(templates.Templates) error {
+	return func(tmplts templates.Templates) error {
+		for name, tmplt := range tmplts {
+			if from := tmplt.Metadata().From; from != "" {
+				if err := senders.Validate(from); err != nil {
+					return fmt.Errorf("template %s: %w", name, err)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func provideTemplates(cfg *Config, senders *mailer.SenderAllowList, logger *zap.SugaredLogger, lifecycle fx.Lifecycle) (templates.Catalog, error) {
+	validate := validateTemplateSenders(senders)
+	if cfg.TemplatesDir == "" {
+		tmplts, err := templates.Load()
+		if err != nil {
+			return nil, err
+		}
+		return tmplts, validate(tmplts)
+	}
+
+	tmplts, err := templates.NewReloadingTemplates(cfg.TemplatesDir, logger, validate)
+	if err != nil {
+		return nil, err
+	}
+	lifecycle.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			return tmplts.Watch()
+		},
+		OnStop: func(ctx context.Context) error {
+			return tmplts.Close()
+		},
+	})
+
+	return tmplts, nil
+}
+
+func provideTemplateSourcesHandler(cfg *Config) (http.Handler, error) {
+	sources, err := templates.SourcesFS(cfg.TemplatesDir)
+	if err != nil {
+		return nil, err
+	}
+	return api.TemplateSourcesHandler(sources), nil
+}
+
+type EmailEventHandlerParams struct {
+	fx.In
+
+	Attachments   *mailer.AttachmentValidator
+	DeadLetters   consumer.DeadLetterProducer
+	Deduplication consumer.DeduplicationStore
+	Fetcher       mailer.AttachmentFetcher
+	GlobalVars    *templates.GlobalVariables
+	Logger        *zap.SugaredLogger
+	Mailer        mailer.Mailer
+	Senders       *mailer.SenderAllowList
+	Suppressions  consumer.SuppressionStore
+	Templates     templates.Catalog
+	Unsubscribe   *consumer.UnsubscribeSigner
+}
+
+func provideEmailEventHandler(params EmailEventHandlerParams) (*consumer.EmailEventHandler, error) {
+	return consumer.NewEmailEventHandler(&consumer.EmailEventHandlerParams{
+		Attachments:   params.Attachments,
+		DeadLetters:   params.DeadLetters,
+		Deduplication: params.Deduplication,
+		Fetcher:       params.Fetcher,
+		GlobalVars:    params.GlobalVars,
+		Logger:        params.Logger,
+		Mailer:        params.Mailer,
+		Senders:       params.Senders,
+		Suppressions:  params.Suppressions,
+		Templates:     params.Templates,
+		Unsubscribe:   params.Unsubscribe,
+	})
+}
+
+func provideEmailSender(handler *consumer.EmailEventHandler) api.EmailSender {
+	return handler
+}
+
+// provideMailboxHandler returns nil unless the memory backend is used, so the mailbox is never exposed in production
+func provideMailboxHandler(logger *zap.SugaredLogger, m mailer.Mailer) (http.Handler, error) {
+	mailbox, ok := m.(*mailer.MemoryMailer)
+	if !ok {
+		return nil, nil
+	}
+	return api.MailboxHandler(logger, mailbox)
+}
+
 type ServerParams struct {
 	fx.In
 
@@ -78,41 +177,74 @@ type ServerParams struct {
 	Lifecycle                fx.Lifecycle
 	TemplateSourcesHandler   http.Handler     `name:"templateSourcesHandler"`
 	RenderedTemplatesHandler http.HandlerFunc `name:"renderedTemplatesHandler"`
+	SendEmailHandler         http.HandlerFunc `name:"sendEmailHandler"`
+	UnsubscribeHandler       http.HandlerFunc `name:"unsubscribeHandler"`
+	SuppressionsHandler      http.Handler     `name:"suppressionsHandler"`
+	SESNotificationsHandler  http.HandlerFunc `name:"sesNotificationsHandler"`
+	MailboxHandler           http.Handler     `name:"mailboxHandler"`
+}
+
+// HttpServers are the public server and the internal server of the admin API
+type HttpServers struct {
+	Public   *http.Server
+	Internal *http.Server
 }
 
-func provideHttpServer(params ServerParams) (*http.Server, error) {
+func provideHttpServers(params ServerParams) (*HttpServers, error) {
 	router := mux.NewRouter()
 	router.Handle("/metrics", promhttp.Handler())
 	router.HandleFunc("/live", api.LiveHandler)
 	router.HandleFunc("/ready", api.ReadyHandler)
-	router.Handle("/rendered/{name}", params.RenderedTemplatesHandler)
+	if params.UnsubscribeHandler != nil {
+		router.Handle("/v1/unsubscribe", params.UnsubscribeHandler).Methods(http.MethodGet, http.MethodPost)
+	}
+	if params.SESNotificationsHandler != nil {
+		router.Handle("/v1/notifications/ses", params.SESNotificationsHandler).Methods(http.MethodPost)
+	}
+	if params.MailboxHandler != nil {
+		router.PathPrefix("/v1/mailbox").Handler(params.MailboxHandler)
+	}
+	router.Handle("/rendered/{name}", params.RenderedTemplatesHandler).Methods(http.MethodGet, http.MethodPost)
 	router.PathPrefix("/").Handler(params.TemplateSourcesHandler)
 
-	server := http.Server{
-		Addr:    fmt.Sprintf(":%v", params.Cfg.ServerPort),
-		Handler: router,
-	}
+	// The admin API is only served by the internal server, because it's not authenticated
+	internalRouter := mux.NewRouter()
+	internalRouter.HandleFunc("/live", api.LiveHandler)
+	internalRouter.HandleFunc("/ready", api.ReadyHandler)
+	internalRouter.Handle("/v1/emails", params.SendEmailHandler).Methods(http.MethodPost)
+	internalRouter.PathPrefix("/v1/suppressions").Handler(params.SuppressionsHandler)
 
-	return &server, nil
+	return &HttpServers{
+		Public: &http.Server{
+			Addr:    fmt.Sprintf(":%v", params.Cfg.ServerPort),
+			Handler: router,
+		},
+		Internal: &http.Server{
+			Addr:    fmt.Sprintf(":%v", params.Cfg.InternalPort),
+			Handler: internalRouter,
+		},
+	}, nil
 }
 
-func start(eventConsumer events.EventConsumer, server *http.Server, logger *zap.SugaredLogger, lifecycle fx.Lifecycle, shutdowner fx.Shutdowner) {
-	lifecycle.Append(fx.Hook{
-		OnStart: func(ctx context.Context) error {
-			go func() {
-				if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-					logger.Error("Failed to start server", zap.Error(err))
-					if err := shutdowner.Shutdown(); err != nil {
-						logger.Error("Failed to invoke shutdowner", zap.Error(err))
+func start(eventConsumer events.EventConsumer, servers *HttpServers, logger *zap.SugaredLogger, lifecycle fx.Lifecycle, shutdowner fx.Shutdowner) {
+	for _, server := range []*http.Server{servers.Public, servers.Internal} {
+		lifecycle.Append(fx.Hook{
+			OnStart: func(ctx context.Context) error {
+				go func() {
+					if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+						logger.Error("Failed to start server", zap.String("addr", server.Addr), zap.Error(err))
+						if err := shutdowner.Shutdown(); err != nil {
+							logger.Error("Failed to invoke shutdowner", zap.Error(err))
+						}
 					}
-				}
-			}()
-			return nil
-		},
-		OnStop: func(ctx context.Context) error {
-			return server.Shutdown(ctx)
-		},
-	})
+				}()
+				return nil
+			},
+			OnStop: func(ctx context.Context) error {
+				return server.Shutdown(ctx)
+			},
+		})
+	}
 
 	lifecycle.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
@@ -140,18 +272,49 @@ func main() {
 			provideLogger,
 			provideBackend,
 			templates.NewGlobalVariables,
-			templates.Load,
+			mailer.NewSenderAllowList,
+			mailer.NewAttachmentValidator,
+			mailer.NewAttachmentFetcher,
+			provideTemplates,
 			mailer.New,
+			consumer.NewConfig,
+			consumer.NewDeadLetterProducer,
+			consumer.NewDeduplicationStore,
+			consumer.NewSuppressionStore,
+			consumer.NewUnsubscribeSigner,
+			notifications.NewProcessor,
+			provideEmailEventHandler,
+			provideEmailSender,
 			consumer.New,
 			fx.Annotated{
 				Name:   "templateSourcesHandler",
-				Target: api.TemplateSourcesHandler,
+				Target: provideTemplateSourcesHandler,
 			},
 			fx.Annotated{
 				Name:   "renderedTemplatesHandler",
 				Target: api.RenderedTemplatesHandler,
 			},
-			provideHttpServer,
+			fx.Annotated{
+				Name:   "sendEmailHandler",
+				Target: api.SendEmailHandler,
+			},
+			fx.Annotated{
+				Name:   "unsubscribeHandler",
+				Target: api.UnsubscribeHandler,
+			},
+			fx.Annotated{
+				Name:   "suppressionsHandler",
+				Target: api.SuppressionsHandler,
+			},
+			fx.Annotated{
+				Name:   "sesNotificationsHandler",
+				Target: api.SESNotificationsHandler,
+			},
+			fx.Annotated{
+				Name:   "mailboxHandler",
+				Target: provideMailboxHandler,
+			},
+			provideHttpServers,
 		),
 		fx.Invoke(start),
 	).Run()
@@ -0,0 +1,27 @@
+package notifications
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	notificationsCounter = createNotificationsCounter()
+)
+
+func createNotificationsCounter() *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "ses_notifications",
+		},
+		[]string{"type", "subtype"},
+	)
+
+	prometheus.MustRegister(counter)
+	return counter
+}
+
+func ObserveNotification(notificationType string, subtype string) {
+	notificationsCounter.WithLabelValues(notificationType, subtype).Inc()
+}
@@ -0,0 +1,207 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/tidepool-org/mailer/consumer"
+	"go.uber.org/zap"
+)
+
+const (
+	NotificationTypeBounce    = "Bounce"
+	NotificationTypeComplaint = "Complaint"
+	NotificationTypeDelivery  = "Delivery"
+
+	BounceTypePermanent = "Permanent"
+)
+
+var ErrInvalidNotification = errors.New("invalid notification")
+
+// SESNotification is the SES bounce, complaint or delivery notification published to SNS. Notifications
+// published by configuration set event destinations use eventType instead of notificationType.
+type SESNotification struct {
+	NotificationType string        `json:"notificationType"`
+	EventType        string        `json:"eventType"`
+	Mail             SESMail       `json:"mail"`
+	Bounce           *SESBounce    `json:"bounce,omitempty"`
+	Complaint        *SESComplaint `json:"complaint,omitempty"`
+	Delivery         *SESDelivery  `json:"delivery,omitempty"`
+}
+
+func (s *SESNotification) Type() string {
+	if s.NotificationType != "" {
+		return s.NotificationType
+	}
+	return s.EventType
+}
+
+type SESMail struct {
+	MessageID   string   `json:"messageId"`
+	Source      string   `json:"source"`
+	Destination []string `json:"destination"`
+}
+
+type SESBounce struct {
+	BounceType        string                `json:"bounceType"`
+	BounceSubType     string                `json:"bounceSubType"`
+	BouncedRecipients []SESBouncedRecipient `json:"bouncedRecipients"`
+	Timestamp         string                `json:"timestamp"`
+}
+
+type SESBouncedRecipient struct {
+	EmailAddress   string `json:"emailAddress"`
+	Status         string `json:"status,omitempty"`
+	DiagnosticCode string `json:"diagnosticCode,omitempty"`
+}
+
+type SESComplaint struct {
+	ComplainedRecipients  []SESComplainedRecipient `json:"complainedRecipients"`
+	ComplaintFeedbackType string                   `json:"complaintFeedbackType,omitempty"`
+	Timestamp             string                   `json:"timestamp"`
+}
+
+type SESComplainedRecipient struct {
+	EmailAddress string `json:"emailAddress"`
+}
+
+type SESDelivery struct {
+	Recipients []string `json:"recipients"`
+	Timestamp  string   `json:"timestamp"`
+}
+
+type ProcessorConfig struct {
+	// TopicARNs are the topics whose notifications are accepted. The notifications endpoint is disabled if it's empty.
+	TopicARNs []string `envconfig:"TIDEPOOL_MAILER_SNS_TOPIC_ARNS"`
+	// MaxMessageAge is the maximum age of the accepted messages
+	MaxMessageAge time.Duration `envconfig:"TIDEPOOL_MAILER_SNS_MAX_MESSAGE_AGE" default:"1h" validate:"min=1"`
+}
+
+// Processor verifies the SNS messages sent to the webhook, confirms subscriptions and feeds
+// permanent bounces and complaints into the suppression list
+type Processor struct {
+	logger       *zap.SugaredLogger
+	suppressions consumer.SuppressionStore
+	verifier     *SNSVerifier
+}
+
+type ProcessorParams struct {
+	Logger       *zap.SugaredLogger
+	Suppressions consumer.SuppressionStore
+	Verifier     *SNSVerifier
+}
+
+// NewProcessor returns nil if no topics are configured
+func NewProcessor(logger *zap.SugaredLogger, validate *validator.Validate, suppressions consumer.SuppressionStore) (*Processor, error) {
+	cfg := &ProcessorConfig{}
+	if err := envconfig.Process("", cfg); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.TopicARNs) == 0 {
+		logger.Warn("SNS topic arns are not set, SES notifications are disabled")
+		return nil, nil
+	}
+	return NewProcessorWithParams(&ProcessorParams{
+		Logger:       logger,
+		Suppressions: suppressions,
+		Verifier:     NewSNSVerifier(&SNSVerifierParams{TopicARNs: cfg.TopicARNs, MaxMessageAge: cfg.MaxMessageAge}),
+	}), nil
+}
+
+func NewProcessorWithParams(params *ProcessorParams) *Processor {
+	return &Processor{
+		logger:       params.Logger,
+		suppressions: params.Suppressions,
+		verifier:     params.Verifier,
+	}
+}
+
+// Process handles the raw SNS message
+func (p *Processor) Process(ctx context.Context, body []byte) error {
+	message := &SNSMessage{}
+	if err := json.Unmarshal(body, message); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidNotification, err)
+	}
+	if err := p.verifier.Verify(ctx, message); err != nil {
+		return err
+	}
+
+	switch message.Type {
+	case SNSTypeSubscriptionConfirmation:
+		if err := p.verifier.ConfirmSubscription(ctx, message); err != nil {
+			return err
+		}
+		p.logger.Infow("Confirmed sns subscription", "topic", message.TopicARN)
+		return nil
+	case SNSTypeUnsubscribeConfirmation:
+		p.logger.Warnw("Unsubscribed from sns topic", "topic", message.TopicARN)
+		return nil
+	case SNSTypeNotification:
+		return p.processNotification(ctx, message)
+	default:
+		return fmt.Errorf("%w: unknown message type %s", ErrInvalidNotification, message.Type)
+	}
+}
+
+func (p *Processor) processNotification(ctx context.Context, message *SNSMessage) error {
+	notification := &SESNotification{}
+	if err := json.Unmarshal([]byte(message.Message), notification); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidNotification, err)
+	}
+
+	switch notification.Type() {
+	case NotificationTypeBounce:
+		if notification.Bounce == nil {
+			return fmt.Errorf("%w: bounce is missing", ErrInvalidNotification)
+		}
+		ObserveNotification(notification.Type(), notification.Bounce.BounceType)
+		if notification.Bounce.BounceType != BounceTypePermanent {
+			p.logger.Infow("Ignoring non-permanent bounce", "messageId", notification.Mail.MessageID, "bounceType", notification.Bounce.BounceType)
+			return nil
+		}
+		for _, recipient := range notification.Bounce.BouncedRecipients {
+			description := strings.TrimSpace(fmt.Sprintf("%s %s", notification.Bounce.BounceSubType, recipient.DiagnosticCode))
+			if err := p.suppress(ctx, recipient.EmailAddress, consumer.SuppressionReasonBounce, description); err != nil {
+				return err
+			}
+		}
+	case NotificationTypeComplaint:
+		if notification.Complaint == nil {
+			return fmt.Errorf("%w: complaint is missing", ErrInvalidNotification)
+		}
+		ObserveNotification(notification.Type(), notification.Complaint.ComplaintFeedbackType)
+		for _, recipient := range notification.Complaint.ComplainedRecipients {
+			if err := p.suppress(ctx, recipient.EmailAddress, consumer.SuppressionReasonComplaint, notification.Complaint.ComplaintFeedbackType); err != nil {
+				return err
+			}
+		}
+	case NotificationTypeDelivery:
+		ObserveNotification(notification.Type(), "")
+	default:
+		ObserveNotification(notification.Type(), "")
+		p.logger.Infow("Ignoring unsupported notification", "type", notification.Type(), "messageId", notification.Mail.MessageID)
+	}
+	return nil
+}
+
+func (p *Processor) suppress(ctx context.Context, email string, reason consumer.SuppressionReason, description string) error {
+	err := p.suppressions.Add(ctx, consumer.Suppression{
+		Email:       email,
+		Reason:      reason,
+		Description: description,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to suppress recipient: %w", err)
+	}
+	p.logger.Infow("Suppressed recipient", "reason", reason, "description", description)
+	return nil
+}
@@ -0,0 +1,240 @@
+package notifications_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/mailer/consumer"
+	"github.com/tidepool-org/mailer/notifications"
+	"go.uber.org/zap"
+)
+
+const topicARN = "arn:aws:sns:us-west-2:123456789012:ses-notifications"
+
+type testSNS struct {
+	server       *httptest.Server
+	key          *rsa.PrivateKey
+	confirmed    atomic.Int32
+	suppressions *consumer.MemorySuppressionStore
+	processor    *notifications.Processor
+}
+
+// newTestSNS serves a locally generated signing certificate and the subscription confirmation url
+func newTestSNS(t *testing.T) *testSNS {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.us-west-2.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	sns := &testSNS{key: key, suppressions: consumer.NewMemorySuppressionStore()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/SimpleNotificationService.pem", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(certificate)
+	})
+	mux.HandleFunc("/confirm", func(w http.ResponseWriter, r *http.Request) {
+		sns.confirmed.Add(1)
+	})
+	sns.server = httptest.NewTLSServer(mux)
+	t.Cleanup(sns.server.Close)
+
+	sns.processor = notifications.NewProcessorWithParams(&notifications.ProcessorParams{
+		Logger:       zap.NewNop().Sugar(),
+		Suppressions: sns.suppressions,
+		Verifier: notifications.NewSNSVerifier(&notifications.SNSVerifierParams{
+			Client:       sns.server.Client(),
+			TopicARNs:    []string{topicARN},
+			TrustedHosts: regexp.MustCompile(`^127\.0\.0\.1$`),
+		}),
+	})
+	return sns
+}
+
+func (s *testSNS) message(t *testing.T, messageType string, message string) *notifications.SNSMessage {
+	msg := &notifications.SNSMessage{
+		Type:             messageType,
+		MessageID:        "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+		TopicARN:         topicARN,
+		Message:          message,
+		Timestamp:        time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		SignatureVersion: "2",
+		SigningCertURL:   s.server.URL + "/SimpleNotificationService.pem",
+	}
+	if messageType == notifications.SNSTypeSubscriptionConfirmation {
+		msg.Token = "token"
+		msg.SubscribeURL = s.server.URL + "/confirm"
+	}
+	return msg
+}
+
+func (s *testSNS) sign(t *testing.T, msg *notifications.SNSMessage) []byte {
+	digest := sha256.Sum256([]byte(msg.StringToSign()))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	msg.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	return body
+}
+
+func readFixture(t *testing.T, name string) string {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	return string(data)
+}
+
+func Test_Processor_Process_Notifications(t *testing.T) {
+	tests := map[string]struct {
+		fixture        string
+		suppressed     string
+		expectedReason consumer.SuppressionReason
+	}{
+		"permanent bounce": {fixture: "bounce.json", suppressed: "bounced@example.com", expectedReason: consumer.SuppressionReasonBounce},
+		"transient bounce": {fixture: "transient_bounce.json"},
+		"complaint":        {fixture: "complaint.json", suppressed: "complained@example.com", expectedReason: consumer.SuppressionReasonComplaint},
+		"delivery":         {fixture: "delivery.json"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			sns := newTestSNS(t)
+			ctx := context.Background()
+
+			body := sns.sign(t, sns.message(t, notifications.SNSTypeNotification, readFixture(t, test.fixture)))
+			if err := sns.processor.Process(ctx, body); err != nil {
+				t.Fatalf(`Error is "%s", but should be nil`, err)
+			}
+
+			suppressions, _ := sns.suppressions.List(ctx)
+			if test.suppressed == "" {
+				if len(suppressions) != 0 {
+					t.Fatalf(`Expected no suppressions, got %v`, suppressions)
+				}
+				return
+			}
+			if len(suppressions) != 1 || suppressions[0].Email != test.suppressed || suppressions[0].Reason != test.expectedReason {
+				t.Fatalf(`Expected %s to be suppressed because of %s, got %v`, test.suppressed, test.expectedReason, suppressions)
+			}
+		})
+	}
+}
+
+func Test_Processor_Process_ConfirmsSubscription(t *testing.T) {
+	sns := newTestSNS(t)
+
+	body := sns.sign(t, sns.message(t, notifications.SNSTypeSubscriptionConfirmation, "You have chosen to subscribe to the topic"))
+	if err := sns.processor.Process(context.Background(), body); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if sns.confirmed.Load() != 1 {
+		t.Fatalf(`Expected the subscription to be confirmed once, got %v`, sns.confirmed.Load())
+	}
+}
+
+func Test_Processor_Process_RejectsInvalidMessages(t *testing.T) {
+	sns := newTestSNS(t)
+	ctx := context.Background()
+
+	tampered := sns.message(t, notifications.SNSTypeNotification, readFixture(t, "bounce.json"))
+	sns.sign(t, tampered)
+	tampered.Message = readFixture(t, "complaint.json")
+	tamperedBody, _ := json.Marshal(tampered)
+	if err := sns.processor.Process(ctx, tamperedBody); !errors.Is(err, notifications.ErrInvalidSignature) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, notifications.ErrInvalidSignature)
+	}
+
+	untrusted := sns.message(t, notifications.SNSTypeNotification, readFixture(t, "bounce.json"))
+	untrusted.SigningCertURL = "https://attacker.example.com/cert.pem"
+	if err := sns.processor.Process(ctx, sns.sign(t, untrusted)); !errors.Is(err, notifications.ErrUntrustedURL) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, notifications.ErrUntrustedURL)
+	}
+
+	unknownTopic := sns.message(t, notifications.SNSTypeNotification, readFixture(t, "bounce.json"))
+	unknownTopic.TopicARN = "arn:aws:sns:us-west-2:123456789012:other"
+	if err := sns.processor.Process(ctx, sns.sign(t, unknownTopic)); !errors.Is(err, notifications.ErrUnknownTopic) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, notifications.ErrUnknownTopic)
+	}
+
+	if suppressions, _ := sns.suppressions.List(ctx); len(suppressions) != 0 {
+		t.Errorf(`Expected no suppressions, got %v`, suppressions)
+	}
+}
+
+func Test_Processor_Process_RejectsStaleMessages(t *testing.T) {
+	sns := newTestSNS(t)
+	ctx := context.Background()
+
+	for name, timestamp := range map[string]string{
+		"old":     time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339),
+		"future":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		"invalid": "yesterday",
+	} {
+		t.Run(name, func(t *testing.T) {
+			stale := sns.message(t, notifications.SNSTypeNotification, readFixture(t, "bounce.json"))
+			stale.Timestamp = timestamp
+			if err := sns.processor.Process(ctx, sns.sign(t, stale)); !errors.Is(err, notifications.ErrStaleMessage) {
+				t.Errorf(`Error is "%v", but should be "%s"`, err, notifications.ErrStaleMessage)
+			}
+		})
+	}
+
+	if suppressions, _ := sns.suppressions.List(ctx); len(suppressions) != 0 {
+		t.Errorf(`Expected no suppressions, got %v`, suppressions)
+	}
+}
+
+func Test_Processor_Process_OnlyConfirmsAcceptedTopics(t *testing.T) {
+	sns := newTestSNS(t)
+
+	confirmation := sns.message(t, notifications.SNSTypeSubscriptionConfirmation, "You have chosen to subscribe to the topic")
+	confirmation.TopicARN = "arn:aws:sns:us-west-2:123456789012:other"
+	if err := sns.processor.Process(context.Background(), sns.sign(t, confirmation)); !errors.Is(err, notifications.ErrUnknownTopic) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, notifications.ErrUnknownTopic)
+	}
+
+	verifier := notifications.NewSNSVerifier(&notifications.SNSVerifierParams{
+		Client:       sns.server.Client(),
+		TrustedHosts: regexp.MustCompile(`^127\.0\.0\.1$`),
+	})
+	if err := verifier.ConfirmSubscription(context.Background(), sns.message(t, notifications.SNSTypeSubscriptionConfirmation, "")); !errors.Is(err, notifications.ErrUnknownTopic) {
+		t.Errorf(`Error is "%v", but should be "%s"`, err, notifications.ErrUnknownTopic)
+	}
+	if sns.confirmed.Load() != 0 {
+		t.Fatalf(`Expected no confirmed subscriptions, got %v`, sns.confirmed.Load())
+	}
+}
@@ -0,0 +1,285 @@
+package notifications
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SNSTypeNotification             = "Notification"
+	SNSTypeSubscriptionConfirmation = "SubscriptionConfirmation"
+	SNSTypeUnsubscribeConfirmation  = "UnsubscribeConfirmation"
+
+	maxCertificateSize = 64 << 10
+
+	// DefaultMaxMessageAge exceeds the longest delivery retry policy of SNS HTTP subscriptions
+	DefaultMaxMessageAge = time.Hour
+	// maxClockSkew is the tolerated difference between the clocks of SNS and the service
+	maxClockSkew = 5 * time.Minute
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid sns signature")
+	ErrUntrustedURL     = errors.New("untrusted sns url")
+	ErrUnknownTopic     = errors.New("unknown sns topic")
+	ErrStaleMessage     = errors.New("stale sns message")
+)
+
+// DefaultTrustedHosts matches the hosts of the SNS signing certificates and subscription urls
+var DefaultTrustedHosts = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// SNSMessage is the envelope of the messages sent by SNS to HTTP subscriptions
+type SNSMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token,omitempty"`
+	TopicARN         string `json:"TopicArn"`
+	Subject          string `json:"Subject,omitempty"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL,omitempty"`
+	UnsubscribeURL   string `json:"UnsubscribeURL,omitempty"`
+}
+
+// StringToSign returns the canonical representation of the message which is signed by SNS
+func (m *SNSMessage) StringToSign() string {
+	var fields [][2]string
+	switch m.Type {
+	case SNSTypeSubscriptionConfirmation, SNSTypeUnsubscribeConfirmation:
+		fields = [][2]string{
+			{"Message", m.Message},
+			{"MessageId", m.MessageID},
+			{"SubscribeURL", m.SubscribeURL},
+			{"Timestamp", m.Timestamp},
+			{"Token", m.Token},
+			{"TopicArn", m.TopicARN},
+			{"Type", m.Type},
+		}
+	default:
+		fields = [][2]string{
+			{"Message", m.Message},
+			{"MessageId", m.MessageID},
+		}
+		if m.Subject != "" {
+			fields = append(fields, [2]string{"Subject", m.Subject})
+		}
+		fields = append(fields,
+			[2]string{"Timestamp", m.Timestamp},
+			[2]string{"TopicArn", m.TopicARN},
+			[2]string{"Type", m.Type},
+		)
+	}
+
+	var builder strings.Builder
+	for _, field := range fields {
+		builder.WriteString(field[0])
+		builder.WriteString("\n")
+		builder.WriteString(field[1])
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+type SNSVerifierParams struct {
+	// Client is used to download the signing certificates and to confirm subscriptions
+	Client *http.Client
+	// TopicARNs are the topics whose messages are accepted, messages from all other topics are rejected
+	TopicARNs []string
+	// TrustedHosts defaults to DefaultTrustedHosts
+	TrustedHosts *regexp.Regexp
+	// MaxMessageAge defaults to DefaultMaxMessageAge, older messages are rejected so they can't be replayed
+	MaxMessageAge time.Duration
+}
+
+// SNSVerifier verifies the signatures of SNS messages and confirms subscriptions
+type SNSVerifier struct {
+	client        *http.Client
+	topicARNs     map[string]bool
+	trustedHosts  *regexp.Regexp
+	maxMessageAge time.Duration
+
+	mu           sync.Mutex
+	certificates map[string]*x509.Certificate
+}
+
+func NewSNSVerifier(params *SNSVerifierParams) *SNSVerifier {
+	verifier := &SNSVerifier{
+		client:        params.Client,
+		topicARNs:     make(map[string]bool, len(params.TopicARNs)),
+		trustedHosts:  params.TrustedHosts,
+		maxMessageAge: params.MaxMessageAge,
+		certificates:  make(map[string]*x509.Certificate),
+	}
+	if verifier.client == nil {
+		verifier.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if verifier.trustedHosts == nil {
+		verifier.trustedHosts = DefaultTrustedHosts
+	}
+	if verifier.maxMessageAge == 0 {
+		verifier.maxMessageAge = DefaultMaxMessageAge
+	}
+	for _, arn := range params.TopicARNs {
+		verifier.topicARNs[arn] = true
+	}
+	return verifier
+}
+
+// Verify checks that the message was recently sent by SNS from one of the accepted topics
+func (v *SNSVerifier) Verify(ctx context.Context, message *SNSMessage) error {
+	if !v.topicARNs[message.TopicARN] {
+		return fmt.Errorf("%w %s", ErrUnknownTopic, message.TopicARN)
+	}
+	if err := v.verifyTimestamp(message.Timestamp); err != nil {
+		return err
+	}
+
+	var hash crypto.Hash
+	switch message.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("%w: unsupported signature version %s", ErrInvalidSignature, message.SignatureVersion)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(message.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+	certificate, err := v.certificate(ctx, message.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: unsupported public key", ErrInvalidSignature)
+	}
+
+	if err := rsa.VerifyPKCS1v15(publicKey, hash, digest(hash, message.StringToSign()), signature); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+	return nil
+}
+
+// ConfirmSubscription visits the subscribe url of a verified subscription confirmation message of one of
+// the accepted topics
+func (v *SNSVerifier) ConfirmSubscription(ctx context.Context, message *SNSMessage) error {
+	if !v.topicARNs[message.TopicARN] {
+		return fmt.Errorf("%w %s", ErrUnknownTopic, message.TopicARN)
+	}
+	if err := v.validateURL(message.SubscribeURL); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, message.SubscribeURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to confirm subscription to %s: status %v", message.TopicARN, res.StatusCode)
+	}
+	return nil
+}
+
+func (v *SNSVerifier) certificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	v.mu.Lock()
+	certificate, ok := v.certificates[certURL]
+	v.mu.Unlock()
+	if ok {
+		return certificate, nil
+	}
+
+	if err := v.validateURL(certURL); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download signing certificate: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to download signing certificate: status %v", res.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxCertificateSize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to download signing certificate: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: signing certificate is not pem encoded", ErrInvalidSignature)
+	}
+	certificate, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+
+	v.mu.Lock()
+	v.certificates[certURL] = certificate
+	v.mu.Unlock()
+	return certificate, nil
+}
+
+// verifyTimestamp rejects signed messages which are too old, because they could be replayed
+func (v *SNSVerifier) verifyTimestamp(timestamp string) error {
+	sent, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp %s: %w", ErrStaleMessage, timestamp, err)
+	}
+	age := time.Since(sent)
+	if age > v.maxMessageAge || age < -maxClockSkew {
+		return fmt.Errorf("%w: sent at %s", ErrStaleMessage, timestamp)
+	}
+	return nil
+}
+
+func (v *SNSVerifier) validateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w %s: %w", ErrUntrustedURL, rawURL, err)
+	}
+	if u.Scheme != "https" || !v.trustedHosts.MatchString(u.Hostname()) {
+		return fmt.Errorf("%w %s", ErrUntrustedURL, rawURL)
+	}
+	return nil
+}
+
+func digest(hash crypto.Hash, value string) []byte {
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum([]byte(value))
+		return sum[:]
+	}
+	sum := sha256.Sum256([]byte(value))
+	return sum[:]
+}
@@ -0,0 +1,150 @@
+package templates
+
+import (
+	"fmt"
+	htmlTemplate "html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"text/template/parse"
+)
+
+const (
+	// inlineImageFunc references an image of the img directory which is embedded into the email,
+	// e.g. <img src="{{ inlineImage `tidepool_logo_light_x2.png` }}">
+	inlineImageFunc = "inlineImage"
+	imagesDir       = "img"
+	// inlineImageDomain is the right side of the Content-IDs of the inline images
+	inlineImageDomain = "tidepool.org"
+)
+
+// inlineImageName matches the image names which are valid left sides of a RFC 2392 Content-ID
+var inlineImageName = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// InlineImage is an image referenced by the template, which is attached to the email as an inline part
+type InlineImage struct {
+	// Name is the file name of the image
+	Name string
+	// ContentID identifies the inline part, e.g. logo.png@tidepool.org
+	ContentID   string
+	ContentType string
+	Data        []byte
+}
+
+func inlineImageContentID(name string) string {
+	return name + "@" + inlineImageDomain
+}
+
+func inlineImageURL(name string) htmlTemplate.URL {
+	return htmlTemplate.URL("cid:" + inlineImageContentID(name))
+}
+
+func loadInlineImages(sources fs.FS, names []string) ([]InlineImage, error) {
+	images := make([]InlineImage, 0, len(names))
+	for _, name := range names {
+		data, err := fs.ReadFile(sources, path.Join(imagesDir, name))
+		if err != nil {
+			return nil, err
+		}
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		images = append(images, InlineImage{Name: name, ContentID: inlineImageContentID(name), ContentType: contentType, Data: data})
+	}
+	return images, nil
+}
+
+// extractInlineImages returns the names of the images referenced by inlineImage calls of the template and
+// the templates it defines. The images are loaded with the template, so the names must be string literals.
+func extractInlineImages(tmpl *htmlTemplate.Template) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	var walk func(node parse.Node) error
+	walk = func(node parse.Node) error {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return nil
+			}
+			for _, child := range n.Nodes {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		case *parse.ActionNode:
+			return walk(n.Pipe)
+		case *parse.TemplateNode:
+			return walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return nil
+			}
+			for _, cmd := range n.Cmds {
+				if err := walk(cmd); err != nil {
+					return err
+				}
+			}
+		case *parse.CommandNode:
+			if identifier, ok := n.Args[0].(*parse.IdentifierNode); ok && identifier.Ident == inlineImageFunc {
+				name, err := inlineImageArgument(n)
+				if err != nil {
+					return err
+				}
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+			for _, arg := range n.Args {
+				if err := walk(arg); err != nil {
+					return err
+				}
+			}
+		case *parse.IfNode:
+			return walkBranches(walk, n.Pipe, n.List, n.ElseList)
+		case *parse.WithNode:
+			return walkBranches(walk, n.Pipe, n.List, n.ElseList)
+		case *parse.RangeNode:
+			return walkBranches(walk, n.Pipe, n.List, n.ElseList)
+		}
+		return nil
+	}
+
+	for _, associated := range tmpl.Templates() {
+		if associated.Tree == nil {
+			continue
+		}
+		if err := walk(associated.Tree.Root); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// inlineImageArgument returns the image name of the inlineImage call, which must be a single string literal
+func inlineImageArgument(n *parse.CommandNode) (string, error) {
+	if len(n.Args) != 2 {
+		return "", fmt.Errorf("%s %s: the argument must be a single string literal", inlineImageFunc, n)
+	}
+	name, ok := n.Args[1].(*parse.StringNode)
+	if !ok {
+		return "", fmt.Errorf("%s %s: the argument must be a string literal", inlineImageFunc, n)
+	}
+	if !inlineImageName.MatchString(name.Text) {
+		return "", fmt.Errorf("%s %s: invalid image name", inlineImageFunc, n)
+	}
+	return name.Text, nil
+}
+
+func walkBranches(walk func(parse.Node) error, pipe *parse.PipeNode, list *parse.ListNode, elseList *parse.ListNode) error {
+	if err := walk(pipe); err != nil {
+		return err
+	}
+	if err := walk(list); err != nil {
+		return err
+	}
+	return walk(elseList)
+}
@@ -2,57 +2,132 @@ package templates
 
 import (
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
+	"os"
 	"strings"
 )
 
 const (
-	bodySuffix    = "_body.html"
-	subjectSuffix = "_subject.txt"
+	bodySuffix     = "_body.html"
+	textBodySuffix = "_body.txt"
+	subjectSuffix  = "_subject.txt"
+	metadataSuffix = "_metadata.json"
+
+	// localeSeparator separates the template name from the locale in translated sources,
+	// e.g. share_invitation_received.es_body.html
+	localeSeparator = "."
 )
 
 //go:embed sources/*
 var Sources embed.FS
 
 func Load() (Templates, error) {
+	sources, err := SourcesFS("")
+	if err != nil {
+		return nil, err
+	}
+	return LoadFromFS(sources)
+}
+
+// SourcesFS returns the template sources of the directory, or the embedded sources if dir is empty
+func SourcesFS(dir string) (fs.FS, error) {
+	if dir != "" {
+		return os.DirFS(dir), nil
+	}
+	return fs.Sub(Sources, "sources")
+}
+
+// LoadFromFS loads all templates and their translations from the root of the file system
+func LoadFromFS(sources fs.FS) (Templates, error) {
 	templates := make(Templates)
-	entries, err := fs.ReadDir(Sources, "sources")
+	translations := make(map[TemplateName]map[string]Template)
+	entries, err := fs.ReadDir(sources, ".")
 	if err != nil {
 		return nil, err
 	}
 
 	for _, entry := range entries {
 		if !entry.IsDir() && strings.HasSuffix(entry.Name(), bodySuffix) {
-			name := strings.TrimSuffix(entry.Name(), bodySuffix)
+			filename := strings.TrimSuffix(entry.Name(), bodySuffix)
+			name, locale, _ := strings.Cut(filename, localeSeparator)
 
-			// Load the html body
-			body, err := Sources.ReadFile(fmt.Sprintf("sources/%s", entry.Name()))
+			template, err := loadTemplate(sources, TemplateName(name), filename)
 			if err != nil {
 				return nil, err
 			}
 
-			// Inline the css
-			html, err := inlineCSS(body)
-			if err != nil {
-				return nil, err
+			if locale == "" {
+				templates[template.Name()] = template
+			} else {
+				if translations[template.Name()] == nil {
+					translations[template.Name()] = make(map[string]Template)
+				}
+				translations[template.Name()][locale] = template
 			}
+		}
+	}
 
-			// Load the email subject template
-			expectedSubjectFilename := fmt.Sprintf("sources/%s%s", name, subjectSuffix)
-			subject, err := Sources.ReadFile(expectedSubjectFilename)
-			if err != nil {
-				return nil, err
-			}
+	for name, locales := range translations {
+		template, ok := templates[name]
+		if !ok {
+			return nil, fmt.Errorf("translations of template %s exist, but the default template is missing", name)
+		}
 
-			template, err := NewPrecompiledTemplate(TemplateName(name), string(subject), html)
-			if err != nil {
-				return nil, err
+		localized := NewLocalizedTemplate(template)
+		for locale, translation := range locales {
+			if err := localized.AddTranslation(locale, translation); err != nil {
+				return nil, fmt.Errorf("invalid locale %s of template %s: %w", locale, name, err)
 			}
-
-			templates[template.Name()] = template
 		}
+		templates[name] = localized
 	}
 
 	return templates, nil
 }
+
+func loadTemplate(sources fs.FS, name TemplateName, filename string) (*PrecompiledTemplate, error) {
+	// Load the html body
+	body, err := fs.ReadFile(sources, filename+bodySuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Inline the css
+	html, err := inlineCSS(sources, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the email subject template
+	subject, err := fs.ReadFile(sources, filename+subjectSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the optional plain text body template
+	textBody, err := fs.ReadFile(sources, filename+textBodySuffix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	template, err := NewPrecompiledTemplateWithText(name, string(subject), html, string(textBody))
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the images which are embedded into the emails
+	if err := template.LoadInlineImages(sources); err != nil {
+		return nil, err
+	}
+
+	// Load the optional metadata shared by all translations
+	metadata, err := loadMetadata(sources, name)
+	if err != nil {
+		return nil, err
+	}
+	template.SetMetadata(metadata)
+
+	return template, nil
+}
@@ -1,7 +1,10 @@
 package templates_test
 
 import (
+	"bytes"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/tidepool-org/mailer/templates"
 )
@@ -62,3 +65,242 @@ func Test_Load_ExpectedTemplates(t *testing.T) {
 		}
 	}
 }
+
+func Test_LoadFromFS_Translations(t *testing.T) {
+	sources := fstest.MapFS{
+		"greeting_subject.txt":       {Data: []byte(`Hello`)},
+		"greeting_body.html":         {Data: []byte(`<p>Hello</p>`)},
+		"greeting.es_subject.txt":    {Data: []byte(`Hola`)},
+		"greeting.es_body.html":      {Data: []byte(`<p>Hola</p>`)},
+		"greeting.fr-CA_subject.txt": {Data: []byte(`Bonjour`)},
+		"greeting.fr-CA_body.html":   {Data: []byte(`<p>Bonjour</p>`)},
+	}
+
+	tmplts, err := templates.LoadFromFS(sources)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(tmplts) != 1 {
+		t.Fatalf(`Expected to have 1 template, got %v`, len(tmplts))
+	}
+
+	expectedSubjects := map[string]string{
+		"":      "Hello",
+		"en-US": "Hello",
+		"es":    "Hola",
+		"es-MX": "Hola",
+		"fr":    "Hello",
+		"fr-ca": "Bonjour",
+		"de":    "Hello",
+		"!!":    "Hello",
+	}
+	for locale, expectedSubject := range expectedSubjects {
+		tmpl, ok := tmplts.Lookup("greeting", locale)
+		if !ok {
+			t.Fatalf("greeting template doesn't exist")
+		}
+		result, err := tmpl.Execute(nil)
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+		if result.Subject != expectedSubject {
+			t.Errorf(`Subject for locale "%s" is "%s", but should be "%s"`, locale, result.Subject, expectedSubject)
+		}
+	}
+}
+
+func Test_LoadFromFS_TranslationWithoutDefault(t *testing.T) {
+	sources := fstest.MapFS{
+		"greeting.es_subject.txt": {Data: []byte(`Hola`)},
+		"greeting.es_body.html":   {Data: []byte(`<p>Hola</p>`)},
+	}
+
+	if _, err := templates.LoadFromFS(sources); err == nil {
+		t.Fatal("Error should not be nil")
+	}
+}
+
+func Test_LoadFromFS_Metadata(t *testing.T) {
+	sources := fstest.MapFS{
+		"greeting_subject.txt":    {Data: []byte(`Hello`)},
+		"greeting_body.html":      {Data: []byte(`<p>Hello</p>`)},
+		"greeting.es_subject.txt": {Data: []byte(`Hola`)},
+		"greeting.es_body.html":   {Data: []byte(`<p>Hola</p>`)},
+		"greeting_metadata.json":  {Data: []byte(`{"reply_to": "support@tidepool.org", "headers": {"X-Tidepool-Category": "greeting"}}`)},
+	}
+
+	tmplts, err := templates.LoadFromFS(sources)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	for _, locale := range []string{"", "es"} {
+		tmpl, _ := tmplts.Lookup("greeting", locale)
+		result, err := tmpl.Execute(nil)
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+		if result.ReplyTo != "support@tidepool.org" {
+			t.Errorf(`Reply-to for locale "%s" is "%s", but should be "support@tidepool.org"`, locale, result.ReplyTo)
+		}
+		if result.Headers["X-Tidepool-Category"] != "greeting" {
+			t.Errorf(`Headers for locale "%s" are %v, but should contain X-Tidepool-Category`, locale, result.Headers)
+		}
+	}
+}
+
+func Test_LoadFromFS_InvalidMetadata(t *testing.T) {
+	tests := map[string]string{
+		"reserved header":            `{"headers": {"From": "attacker@example.com"}}`,
+		"invalid configuration set":  `{"configuration_set": "marketing emails"}`,
+		"topic without contact list": `{"topic": "reminders"}`,
+	}
+
+	for name, metadata := range tests {
+		t.Run(name, func(t *testing.T) {
+			sources := fstest.MapFS{
+				"greeting_subject.txt":   {Data: []byte(`Hello`)},
+				"greeting_body.html":     {Data: []byte(`<p>Hello</p>`)},
+				"greeting_metadata.json": {Data: []byte(metadata)},
+			}
+
+			if _, err := templates.LoadFromFS(sources); err == nil {
+				t.Fatal("Error should not be nil")
+			}
+		})
+	}
+}
+
+func Test_LoadFromFS_Stylesheet(t *testing.T) {
+	sources := fstest.MapFS{
+		"greeting_subject.txt": {Data: []byte(`Hello`)},
+		"greeting_body.html":   {Data: []byte(`<html><head><link rel="stylesheet" type="text/css" href="./css/styles.css" /></head><body><p class="greeting">Hello</p></body></html>`)},
+		"css/styles.css":       {Data: []byte(`.greeting { color: #123456; }`)},
+	}
+
+	tmplts, err := templates.LoadFromFS(sources)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	tmpl, _ := tmplts.Lookup("greeting", "")
+	result, err := tmpl.Execute(nil)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if !strings.Contains(result.Body, "#123456") {
+		t.Errorf(`Body should inline the stylesheet of the sources, got %s`, result.Body)
+	}
+}
+
+func Test_LoadFromFS_MissingStylesheet(t *testing.T) {
+	sources := fstest.MapFS{
+		"greeting_subject.txt": {Data: []byte(`Hello`)},
+		"greeting_body.html":   {Data: []byte(`<html><head><link rel="stylesheet" type="text/css" href="./css/styles.css" /></head><body>Hello</body></html>`)},
+	}
+
+	if _, err := templates.LoadFromFS(sources); err == nil {
+		t.Fatal("Error should not be nil")
+	}
+}
+
+func Test_LoadFromFS_InlineImages(t *testing.T) {
+	logo := []byte("\x89PNG\r\n\x1a\n")
+	sources := fstest.MapFS{
+		"greeting_subject.txt": {Data: []byte(`Hello`)},
+		"greeting_body.html":   {Data: []byte("<p><img src=\"{{ inlineImage `logo.png` }}\" alt=\"Tidepool\"> Hello</p>")},
+		"img/logo.png":         {Data: logo},
+	}
+
+	tmplts, err := templates.LoadFromFS(sources)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	tmpl, _ := tmplts.Lookup("greeting", "")
+	result, err := tmpl.Execute(nil)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if !strings.Contains(result.Body, `src="cid:logo.png@tidepool.org"`) {
+		t.Errorf(`Body should reference the image by content id, got %s`, result.Body)
+	}
+	if len(result.InlineImages) != 1 {
+		t.Fatalf(`Inline images are %v, but should contain logo.png`, result.InlineImages)
+	}
+	image := result.InlineImages[0]
+	if image.Name != "logo.png" || image.ContentID != "logo.png@tidepool.org" || image.ContentType != "image/png" || !bytes.Equal(image.Data, logo) {
+		t.Errorf(`Inline image is %s %s %s, but should be logo.png logo.png@tidepool.org image/png`, image.Name, image.ContentID, image.ContentType)
+	}
+}
+
+func Test_LoadFromFS_MissingInlineImage(t *testing.T) {
+	sources := fstest.MapFS{
+		"greeting_subject.txt": {Data: []byte(`Hello`)},
+		"greeting_body.html":   {Data: []byte("<p><img src=\"{{ inlineImage `logo.png` }}\"> Hello</p>")},
+	}
+
+	if _, err := templates.LoadFromFS(sources); err == nil {
+		t.Fatal("Error should not be nil")
+	}
+}
+
+func Test_Load_MarketingTemplates(t *testing.T) {
+	tmplts, err := templates.Load()
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	marketing := map[templates.TemplateName]bool{
+		"patient_upload_reminder":           true,
+		"reminder_abbott_connect_custodial": true,
+		"reminder_dexcom_connect_custodial": true,
+		"reminder_twiist_connect_custodial": true,
+	}
+	for name, tmplt := range tmplts {
+		if category := tmplt.Metadata().Category; (category == templates.CategoryMarketing) != marketing[name] {
+			t.Errorf(`Category of template %s is "%s"`, name, category)
+		}
+	}
+}
+
+func Test_LoadFromFS_InvalidInlineImages(t *testing.T) {
+	tests := map[string]string{
+		"variable":       "<img src=\"{{ inlineImage .Logo }}\">",
+		"pipeline":       "<img src=\"{{ `logo.png` | inlineImage }}\">",
+		"invalid name":   "<img src=\"{{ inlineImage `../logo.png` }}\">",
+		"in define":      "{{ define `logo` }}<img src=\"{{ inlineImage .Logo }}\">{{ end }}{{ template `logo` . }}",
+		"without images": "<img src=\"{{ inlineImage }}\">",
+	}
+
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			sources := fstest.MapFS{
+				"greeting_subject.txt": {Data: []byte(`Hello`)},
+				"greeting_body.html":   {Data: []byte(body)},
+				"img/logo.png":         {Data: []byte("\x89PNG\r\n\x1a\n")},
+			}
+			if _, err := templates.LoadFromFS(sources); err == nil {
+				t.Fatal("Error should not be nil")
+			}
+		})
+	}
+}
+
+func Test_LoadFromFS_InlineImagesOfDefinedTemplates(t *testing.T) {
+	sources := fstest.MapFS{
+		"greeting_subject.txt": {Data: []byte(`Hello`)},
+		"greeting_body.html":   {Data: []byte("{{ define `logo` }}<img src=\"{{ inlineImage `logo.png` }}\">{{ end }}{{ template `logo` . }}<p>Hello</p>")},
+		"img/logo.png":         {Data: []byte("\x89PNG\r\n\x1a\n")},
+	}
+
+	tmplts, err := templates.LoadFromFS(sources)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	tmpl, _ := tmplts.Lookup("greeting", "")
+	result, err := tmpl.Execute(nil)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if len(result.InlineImages) != 1 || result.InlineImages[0].ContentID != "logo.png@tidepool.org" {
+		t.Fatalf(`Inline images are %v, but should contain logo.png`, result.InlineImages)
+	}
+}
@@ -0,0 +1,80 @@
+package templates
+
+import (
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+const (
+	// DefaultLocale is the language of the templates without a locale suffix
+	DefaultLocale = "en"
+
+	// LocaleVariable is the name of the event variable which holds the recipient's preferred language
+	LocaleVariable = "Locale"
+)
+
+// LocalizedTemplate is a template with translations. Executing it directly renders the default language.
+type LocalizedTemplate struct {
+	Template
+	translations map[string]Template
+}
+
+func NewLocalizedTemplate(template Template) *LocalizedTemplate {
+	return &LocalizedTemplate{
+		Template:     template,
+		translations: make(map[string]Template),
+	}
+}
+
+// AddTranslation registers the template for a BCP-47 language tag
+func (l *LocalizedTemplate) AddTranslation(locale string, template Template) error {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return err
+	}
+	l.translations[tag.String()] = template
+	return nil
+}
+
+// Localize returns the translation which best matches the locale, falling back to less specific
+// tags (e.g. es-MX -> es) and to the default language if no translation is available
+func (l *LocalizedTemplate) Localize(locale string) Template {
+	for _, candidate := range fallbackChain(locale) {
+		if template, ok := l.translations[candidate]; ok {
+			return template
+		}
+	}
+	return l.Template
+}
+
+// Lookup returns the template with the given name in the language that best matches the locale
+func (t Templates) Lookup(name TemplateName, locale string) (Template, bool) {
+	template, ok := t[name]
+	if !ok {
+		return nil, false
+	}
+	if localized, ok := template.(*LocalizedTemplate); ok {
+		return localized.Localize(locale), true
+	}
+	return template, true
+}
+
+// fallbackChain returns the canonical form of the locale followed by its less specific parents
+func fallbackChain(locale string) []string {
+	tag, err := language.Parse(locale)
+	if err != nil || tag == language.Und {
+		return nil
+	}
+
+	var chain []string
+	for candidate := tag.String(); candidate != ""; {
+		chain = append(chain, candidate)
+		i := strings.LastIndex(candidate, "-")
+		if i < 0 {
+			break
+		}
+		candidate = candidate[:i]
+	}
+	return chain
+}
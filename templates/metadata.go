@@ -0,0 +1,79 @@
+package templates
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/mail"
+
+	"github.com/tidepool-org/mailer/mailer"
+)
+
+const (
+	// CategoryTransactional emails are sent in response to an action of the user or a clinic
+	CategoryTransactional = "transactional"
+	// CategoryMarketing emails are not strictly required, so the recipients can unsubscribe from them
+	CategoryMarketing = "marketing"
+)
+
+// Metadata holds the optional defaults of the emails rendered from a template. It is loaded from
+// <name>_metadata.json and shared by all translations of the template.
+type Metadata struct {
+	// Category is either transactional (default) or marketing
+	Category string `json:"category,omitempty"`
+	// From is the sender of the emails, e.g. "Tidepool Clinics <clinics@tidepool.org>"
+	From    string            `json:"from,omitempty"`
+	ReplyTo string            `json:"reply_to,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// ConfigurationSet overrides the default SES configuration set of the emails
+	ConfigurationSet string `json:"configuration_set,omitempty"`
+	// ContactList and Topic enable the SES list management of the emails
+	ContactList string `json:"contact_list,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+}
+
+func (m Metadata) validate() error {
+	if m.Category != "" && m.Category != CategoryTransactional && m.Category != CategoryMarketing {
+		return fmt.Errorf("invalid category %s", m.Category)
+	}
+	if m.From != "" {
+		if _, err := mail.ParseAddress(m.From); err != nil {
+			return fmt.Errorf("invalid sender %s: %w", m.From, err)
+		}
+	}
+	if m.ReplyTo != "" {
+		if _, err := mail.ParseAddress(m.ReplyTo); err != nil {
+			return fmt.Errorf("invalid reply-to address %s: %w", m.ReplyTo, err)
+		}
+	}
+	if m.ConfigurationSet != "" {
+		if err := mailer.ValidateConfigurationSet(m.ConfigurationSet); err != nil {
+			return err
+		}
+	}
+	if m.Topic != "" && m.ContactList == "" {
+		return fmt.Errorf("topic %s requires a contact list", m.Topic)
+	}
+	return mailer.ValidateHeaders(m.Headers)
+}
+
+func loadMetadata(sources fs.FS, name TemplateName) (Metadata, error) {
+	metadata := Metadata{}
+	data, err := fs.ReadFile(sources, name.String()+metadataSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return metadata, nil
+	} else if err != nil {
+		return metadata, err
+	}
+
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata, fmt.Errorf("invalid metadata of template %s: %w", name, err)
+	}
+	if err := metadata.validate(); err != nil {
+		return metadata, fmt.Errorf("invalid metadata of template %s: %w", name, err)
+	}
+	// The headers are canonicalized, so the headers of events override them regardless of the case
+	metadata.Headers = mailer.MergeHeaders(nil, metadata.Headers)
+	return metadata, nil
+}
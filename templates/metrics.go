@@ -0,0 +1,29 @@
+package templates
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reloadCounter = createReloadCounter()
+)
+
+func createReloadCounter() *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidepool",
+			Subsystem: "mailer",
+			Name:      "template_reloads",
+		},
+		[]string{"success"},
+	)
+
+	prometheus.MustRegister(counter)
+	return counter
+}
+
+func ObserveReload(success bool) {
+	reloadCounter.WithLabelValues(strconv.FormatBool(success)).Inc()
+}
@@ -1,13 +1,14 @@
 package templates
 
 import (
-	_ "embed"
 	"github.com/vanng822/go-premailer/premailer"
+	"io/fs"
 	"strings"
 )
 
 const (
 	cssRef = "<link rel=\"stylesheet\" type=\"text/css\" href=\"./css/styles.css\" />"
+	cssPath = "css/styles.css"
 	replacementStartTag = "<style type=\"text/css\">"
 	replacementEndTag = "</style>"
 )
@@ -18,12 +19,17 @@ var opts = premailer.Options{
 	KeepBangImportant: true,
 }
 
-//go:embed sources/css/styles.css
-var styles []byte
-
-func inlineCSS(html []byte) (string, error){
-	replacement := strings.Join([]string{replacementStartTag, string(styles), replacementEndTag}, "\n")
-	body := strings.ReplaceAll(string(html), cssRef, replacement)
+// inlineCSS replaces the stylesheet link with the stylesheet of the template sources and inlines it
+func inlineCSS(sources fs.FS, html []byte) (string, error){
+	body := string(html)
+	if strings.Contains(body, cssRef) {
+		styles, err := fs.ReadFile(sources, cssPath)
+		if err != nil {
+			return "", err
+		}
+		replacement := strings.Join([]string{replacementStartTag, string(styles), replacementEndTag}, "\n")
+		body = strings.ReplaceAll(body, cssRef, replacement)
+	}
 	prem, err := premailer.NewPremailerFromString(body, &opts)
 	if err != nil {
 		return "", err
@@ -0,0 +1,157 @@
+package templates
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// reloadDelay debounces the bursts of file system events produced by editors and deployments
+const reloadDelay = time.Millisecond * 500
+
+// Catalog looks up templates by name and locale. It is implemented by Templates and by ReloadingTemplates.
+type Catalog interface {
+	Lookup(name TemplateName, locale string) (Template, bool)
+}
+
+var _ Catalog = Templates{}
+var _ Catalog = &ReloadingTemplates{}
+
+// ReloadingTemplates loads the templates from a directory and atomically swaps them whenever
+// the directory changes. The current templates are kept if the new ones can't be loaded or
+// are rejected by the optional validation function.
+type ReloadingTemplates struct {
+	dir      string
+	logger   *zap.SugaredLogger
+	validate func(Templates) error
+
+	current atomic.Pointer[Templates]
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func NewReloadingTemplates(dir string, logger *zap.SugaredLogger, validate func(Templates) error) (*ReloadingTemplates, error) {
+	r := &ReloadingTemplates{
+		dir:      dir,
+		logger:   logger,
+		validate: validate,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *ReloadingTemplates) Lookup(name TemplateName, locale string) (Template, bool) {
+	return r.Templates().Lookup(name, locale)
+}
+
+// Templates returns the currently loaded templates
+func (r *ReloadingTemplates) Templates() Templates {
+	return *r.current.Load()
+}
+
+// Reload loads the templates from the directory and swaps them only if all templates were loaded successfully
+func (r *ReloadingTemplates) Reload() error {
+	sources, err := SourcesFS(r.dir)
+	if err != nil {
+		ObserveReload(false)
+		return err
+	}
+	tmplts, err := LoadFromFS(sources)
+	if err == nil && r.validate != nil {
+		err = r.validate(tmplts)
+	}
+	if err != nil {
+		ObserveReload(false)
+		return err
+	}
+	r.current.Store(&tmplts)
+	ObserveReload(true)
+	return nil
+}
+
+// Watch reloads the templates when the directory or its subdirectories (e.g. css and img) change until
+// Close is called
+func (r *ReloadingTemplates) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watchDirs(watcher, r.dir); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	r.watcher = watcher
+	r.done = make(chan struct{})
+	go r.watch()
+	return nil
+}
+
+func (r *ReloadingTemplates) Close() error {
+	if r.watcher == nil {
+		return nil
+	}
+	err := r.watcher.Close()
+	<-r.done
+	return err
+}
+
+func (r *ReloadingTemplates) watch() {
+	defer close(r.done)
+
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchDirs(r.watcher, event.Name); err != nil {
+						r.logger.Warnw("Unable to watch templates directory", "dir", event.Name, "error", err)
+					}
+				}
+			}
+			timer.Reset(reloadDelay)
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			r.logger.Warnw("Error while watching templates directory", "dir", r.dir, "error", err)
+		case <-timer.C:
+			if err := r.Reload(); err != nil {
+				r.logger.Errorw("Unable to reload templates, keeping the previously loaded templates", "dir", r.dir, "error", err)
+			} else {
+				r.logger.Infow("Reloaded templates", "dir", r.dir)
+			}
+		}
+	}
+}
+
+// watchDirs adds the directory and all of its subdirectories to the watcher, because fsnotify doesn't
+// watch directories recursively
+func watchDirs(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		return watcher.Add(path)
+	})
+}
@@ -0,0 +1,131 @@
+package templates_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/mailer/templates"
+	"go.uber.org/zap"
+)
+
+func writeTemplate(t *testing.T, dir string, subject string, body string) {
+	if err := os.WriteFile(filepath.Join(dir, "greeting_subject.txt"), []byte(subject), 0o644); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "greeting_body.html"), []byte(body), 0o644); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+}
+
+func renderSubject(t *testing.T, catalog templates.Catalog) string {
+	tmplt, ok := catalog.Lookup("greeting", "")
+	if !ok {
+		t.Fatal("Template greeting should exist")
+	}
+	result, err := tmplt.Execute(map[string]string{"Name": "Jo"})
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	return result.Subject
+}
+
+func Test_ReloadingTemplates_Reload(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, `Hello {{ .Name }}`, `<p>Hello {{ .Name }}</p>`)
+	tmplts, err := templates.NewReloadingTemplates(dir, zap.NewNop().Sugar(), nil)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if subject := renderSubject(t, tmplts); subject != "Hello Jo" {
+		t.Fatalf(`Subject is "%s", but should be "Hello Jo"`, subject)
+	}
+
+	writeTemplate(t, dir, `Hi {{ .Name }}`, `<p>Hi {{ .Name }}</p>`)
+	if err := tmplts.Reload(); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if subject := renderSubject(t, tmplts); subject != "Hi Jo" {
+		t.Fatalf(`Subject is "%s", but should be "Hi Jo"`, subject)
+	}
+}
+
+func Test_ReloadingTemplates_Reload_KeepsTemplatesOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, `Hello {{ .Name }}`, `<p>Hello {{ .Name }}</p>`)
+	tmplts, err := templates.NewReloadingTemplates(dir, zap.NewNop().Sugar(), nil)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	writeTemplate(t, dir, `Hi {{ .Name`, `<p>Hi {{ .Name }}</p>`)
+	if err := tmplts.Reload(); err == nil {
+		t.Fatal("Error should not be nil")
+	}
+	if subject := renderSubject(t, tmplts); subject != "Hello Jo" {
+		t.Fatalf(`Subject is "%s", but should be "Hello Jo"`, subject)
+	}
+}
+
+func Test_ReloadingTemplates_Watch(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, `Hello {{ .Name }}`, `<p>Hello {{ .Name }}</p>`)
+	tmplts, err := templates.NewReloadingTemplates(dir, zap.NewNop().Sugar(), nil)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if err := tmplts.Watch(); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	defer tmplts.Close()
+
+	writeTemplate(t, dir, `Hi {{ .Name }}`, `<p>Hi {{ .Name }}</p>`)
+	deadline := time.Now().Add(5 * time.Second)
+	for renderSubject(t, tmplts) != "Hi Jo" {
+		if time.Now().After(deadline) {
+			t.Fatal("Templates were not reloaded after the directory changed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func Test_ReloadingTemplates_Watch_Subdirectories(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "css"), 0o755); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	writeStylesheet := func(color string) {
+		if err := os.WriteFile(filepath.Join(dir, "css", "styles.css"), []byte(`p { color: `+color+`; }`), 0o644); err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+	}
+	writeStylesheet("#111111")
+	writeTemplate(t, dir, `Hello {{ .Name }}`, `<html><head><link rel="stylesheet" type="text/css" href="./css/styles.css" /></head><body><p>Hello {{ .Name }}</p></body></html>`)
+	tmplts, err := templates.NewReloadingTemplates(dir, zap.NewNop().Sugar(), nil)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if err := tmplts.Watch(); err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	defer tmplts.Close()
+
+	writeStylesheet("#222222")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		template, _ := tmplts.Lookup("greeting", "")
+		result, err := template.Execute(map[string]string{"Name": "Jo"})
+		if err != nil {
+			t.Fatalf(`Error is "%s", but should be nil`, err)
+		}
+		if strings.Contains(result.Body, "#222222") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Templates were not reloaded after the stylesheet changed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
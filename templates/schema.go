@@ -0,0 +1,174 @@
+package templates
+
+import (
+	htmlTemplate "html/template"
+	"sort"
+	textTemplate "text/template"
+	"text/template/parse"
+)
+
+// VariableSchema describes the variables referenced by a template. Variables which are only
+// referenced in conditionals (e.g. {{ if .FullName }}Hi {{ .FullName }}{{ end }}) are optional,
+// all others are required.
+type VariableSchema struct {
+	Required []string `json:"required"`
+	Optional []string `json:"optional"`
+}
+
+// Missing returns the required variables which are not present
+func (v VariableSchema) Missing(vars map[string]string) []string {
+	var missing []string
+	for _, name := range v.Required {
+		if _, ok := vars[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// templateTrees is the parse tree of a template and the trees of the templates it can invoke by name
+type templateTrees struct {
+	root  *parse.Tree
+	named map[string]*parse.Tree
+}
+
+func textTemplateTrees(t *textTemplate.Template) templateTrees {
+	trees := templateTrees{root: t.Tree, named: make(map[string]*parse.Tree)}
+	for _, associated := range t.Templates() {
+		trees.named[associated.Name()] = associated.Tree
+	}
+	return trees
+}
+
+func htmlTemplateTrees(t *htmlTemplate.Template) templateTrees {
+	trees := templateTrees{root: t.Tree, named: make(map[string]*parse.Tree)}
+	for _, associated := range t.Templates() {
+		trees.named[associated.Name()] = associated.Tree
+	}
+	return trees
+}
+
+// extractVariableSchema collects the variables referenced by the top level fields of the parse trees,
+// including the fields referenced by the templates they invoke with the top level data
+func extractVariableSchema(templates ...templateTrees) VariableSchema {
+	s := &schemaExtractor{
+		referenced:    make(map[string]bool),
+		unconditional: make(map[string]bool),
+		invoking:      make(map[string]bool),
+	}
+	for _, trees := range templates {
+		if trees.root != nil && trees.root.Root != nil {
+			s.named = trees.named
+			s.node(trees.root.Root, false, true)
+		}
+	}
+
+	schema := VariableSchema{
+		Required: []string{},
+		Optional: []string{},
+	}
+	for name := range s.referenced {
+		if s.unconditional[name] {
+			schema.Required = append(schema.Required, name)
+		} else {
+			schema.Optional = append(schema.Optional, name)
+		}
+	}
+	sort.Strings(schema.Required)
+	sort.Strings(schema.Optional)
+	return schema
+}
+
+type schemaExtractor struct {
+	referenced    map[string]bool
+	unconditional map[string]bool
+	named         map[string]*parse.Tree
+	// invoking guards against recursive template invocations
+	invoking map[string]bool
+}
+
+// node walks the node, dotIsRoot is false where the dot is rebound to something other than the top
+// level data, e.g. in the body of with and range, so only $-rooted fields are referenced there
+func (s *schemaExtractor) node(node parse.Node, conditional bool, dotIsRoot bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			s.node(child, conditional, dotIsRoot)
+		}
+	case *parse.ActionNode:
+		s.node(n.Pipe, conditional, dotIsRoot)
+	case *parse.TemplateNode:
+		s.node(n.Pipe, conditional, dotIsRoot)
+		s.template(n, conditional, dotIsRoot)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			s.node(cmd, conditional, dotIsRoot)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			s.node(arg, conditional, dotIsRoot)
+		}
+	case *parse.ChainNode:
+		s.node(n.Node, conditional, dotIsRoot)
+	case *parse.FieldNode:
+		if dotIsRoot {
+			s.field(n.Ident[0], conditional)
+		}
+	case *parse.VariableNode:
+		// $.Name references the root of the data
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			s.field(n.Ident[1], conditional)
+		}
+	case *parse.IfNode:
+		s.node(n.Pipe, true, dotIsRoot)
+		s.node(n.List, true, dotIsRoot)
+		s.node(n.ElseList, true, dotIsRoot)
+	case *parse.WithNode:
+		// The dot is rebound inside the body of with, only the else branch uses the same dot
+		s.node(n.Pipe, true, dotIsRoot)
+		s.node(n.List, true, false)
+		s.node(n.ElseList, true, dotIsRoot)
+	case *parse.RangeNode:
+		s.node(n.Pipe, true, dotIsRoot)
+		s.node(n.List, true, false)
+		s.node(n.ElseList, true, dotIsRoot)
+	}
+}
+
+// template walks the invoked template if it's invoked with the top level data, i.e. {{ template "x" . }}
+// or {{ template "x" $ }}. Otherwise both the dot and $ are something else inside of the template.
+func (s *schemaExtractor) template(n *parse.TemplateNode, conditional bool, dotIsRoot bool) {
+	tree := s.named[n.Name]
+	if tree == nil || tree.Root == nil || s.invoking[n.Name] || !passesRoot(n.Pipe, dotIsRoot) {
+		return
+	}
+	s.invoking[n.Name] = true
+	s.node(tree.Root, conditional, true)
+	s.invoking[n.Name] = false
+}
+
+func passesRoot(pipe *parse.PipeNode, dotIsRoot bool) bool {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	switch arg := pipe.Cmds[0].Args[0].(type) {
+	case *parse.DotNode:
+		return dotIsRoot
+	case *parse.VariableNode:
+		return len(arg.Ident) == 1 && arg.Ident[0] == "$"
+	}
+	return false
+}
+
+func (s *schemaExtractor) field(name string, conditional bool) {
+	s.referenced[name] = true
+	if !conditional {
+		s.unconditional[name] = true
+	}
+}
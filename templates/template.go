@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	htmlTemplate "html/template"
+	"io/fs"
+	"maps"
 	"strconv"
 	"strings"
 	textTemplate "text/template"
@@ -22,23 +24,42 @@ const (
 
 type Template interface {
 	Name() TemplateName
+	Variables() VariableSchema
+	Metadata() Metadata
 	Execute(content interface{}) (*RenderedTemplate, error)
 }
 
 type Templates map[TemplateName]Template
 
 type RenderedTemplate struct {
-	Subject string
-	Body    string
+	Subject  string
+	Body     string
+	TextBody string
+	From     string
+	ReplyTo  string
+	Headers  map[string]string
+	// InlineImages are the images referenced by the body, which must be attached as inline parts
+	InlineImages []InlineImage
 }
 
 type PrecompiledTemplate struct {
 	name               TemplateName
 	precompiledSubject *textTemplate.Template
 	precompiledBody    *htmlTemplate.Template
+	precompiledText    *textTemplate.Template
+	variables          VariableSchema
+	metadata           Metadata
+	inlineImageNames   []string
+	inlineImages       []InlineImage
 }
 
 func NewPrecompiledTemplate(name TemplateName, subjectTemplate string, bodyTemplate string) (*PrecompiledTemplate, error) {
+	return NewPrecompiledTemplateWithText(name, subjectTemplate, bodyTemplate, "")
+}
+
+// NewPrecompiledTemplateWithText creates a template with an explicit plain text body. When the
+// text body template is empty, the plain text alternative is generated from the rendered html body.
+func NewPrecompiledTemplateWithText(name TemplateName, subjectTemplate string, bodyTemplate string, textBodyTemplate string) (*PrecompiledTemplate, error) {
 	if name == TemplateNameUndefined {
 		return nil, errors.New("models: name is missing")
 	}
@@ -58,17 +79,42 @@ func NewPrecompiledTemplate(name TemplateName, subjectTemplate string, bodyTempl
 	}
 
 	precompiledBody, err := htmlTemplate.New(name.String()).Funcs(htmlTemplate.FuncMap{
-		"toLower": strings.ToLower,
-		"toTitle": strings.Title,
+		"toLower":       strings.ToLower,
+		"toTitle":       strings.Title,
+		inlineImageFunc: inlineImageURL,
 	}).Parse(bodyTemplate)
 	if err != nil {
 		return nil, fmt.Errorf("models: failure to precompile body template: %s", err)
 	}
 
+	var precompiledText *textTemplate.Template
+	if textBodyTemplate != "" {
+		precompiledText, err = textTemplate.New(name.String()).Funcs(textTemplate.FuncMap{
+			"toLower": strings.ToLower,
+			"toTitle": strings.Title,
+		}).Parse(textBodyTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("models: failure to precompile text body template: %s", err)
+		}
+	}
+
+	inlineImageNames, err := extractInlineImages(precompiledBody)
+	if err != nil {
+		return nil, fmt.Errorf("models: invalid inline image of body template: %w", err)
+	}
+
+	variables := extractVariableSchema(textTemplateTrees(precompiledSubject), htmlTemplateTrees(precompiledBody))
+	if precompiledText != nil {
+		variables = extractVariableSchema(textTemplateTrees(precompiledSubject), htmlTemplateTrees(precompiledBody), textTemplateTrees(precompiledText))
+	}
+
 	return &PrecompiledTemplate{
 		name:               name,
 		precompiledSubject: precompiledSubject,
 		precompiledBody:    precompiledBody,
+		precompiledText:    precompiledText,
+		variables:          variables,
+		inlineImageNames:   inlineImageNames,
 	}, nil
 }
 
@@ -76,6 +122,29 @@ func (p *PrecompiledTemplate) Name() TemplateName {
 	return p.name
 }
 
+func (p *PrecompiledTemplate) Variables() VariableSchema {
+	return p.variables
+}
+
+func (p *PrecompiledTemplate) Metadata() Metadata {
+	return p.metadata
+}
+
+// LoadInlineImages loads the images referenced by the body from the img directory of the sources
+func (p *PrecompiledTemplate) LoadInlineImages(sources fs.FS) error {
+	images, err := loadInlineImages(sources, p.inlineImageNames)
+	if err != nil {
+		return fmt.Errorf("models: failure to load inline images of template %s: %w", strconv.Quote(p.name.String()), err)
+	}
+	p.inlineImages = images
+	return nil
+}
+
+// SetMetadata sets the defaults of the emails rendered from the template
+func (p *PrecompiledTemplate) SetMetadata(metadata Metadata) {
+	p.metadata = metadata
+}
+
 func (p *PrecompiledTemplate) Execute(content interface{}) (*RenderedTemplate, error) {
 	var subjectBuffer bytes.Buffer
 	var bodyBuffer bytes.Buffer
@@ -88,8 +157,28 @@ func (p *PrecompiledTemplate) Execute(content interface{}) (*RenderedTemplate, e
 		return nil, fmt.Errorf("models: failure to execute body template %s with content", strconv.Quote(p.name.String()))
 	}
 
+	var textBody string
+	if p.precompiledText != nil {
+		var textBuffer bytes.Buffer
+		if err := p.precompiledText.Execute(&textBuffer, content); err != nil {
+			return nil, fmt.Errorf("models: failure to execute text body template %s with content", strconv.Quote(p.name.String()))
+		}
+		textBody = textBuffer.String()
+	} else {
+		var err error
+		if textBody, err = htmlToText(bodyBuffer.String()); err != nil {
+			return nil, fmt.Errorf("models: failure to convert body template %s to text", strconv.Quote(p.name.String()))
+		}
+	}
+
 	return &RenderedTemplate{
-		Subject: subjectBuffer.String(),
-		Body:    bodyBuffer.String(),
+		Subject:  subjectBuffer.String(),
+		Body:     bodyBuffer.String(),
+		TextBody: textBody,
+		From:     p.metadata.From,
+		ReplyTo:  p.metadata.ReplyTo,
+		Headers:  maps.Clone(p.metadata.Headers),
+
+		InlineImages: p.inlineImages,
 	}, nil
 }
@@ -1,8 +1,10 @@
 package templates_test
 
 import (
-	"github.com/tidepool-org/mailer/templates"
+	"strings"
 	"testing"
+
+	"github.com/tidepool-org/mailer/templates"
 )
 
 type (
@@ -111,3 +113,73 @@ func Test_NewPrecompiledTemplate_ExecuteSuccess(t *testing.T) {
 		t.Fatalf(`Body is "%s", but should be "%s"`, result.Body, expectedBody)
 	}
 }
+
+func Test_NewPrecompiledTemplate_ExecuteTextFromHTML(t *testing.T) {
+	htmlBody := `<html><head><title>Ignored</title><style>p { color: red; }</style></head><body>` +
+		`<table><tr><td><p>Hello   {{ .Username }},</p><p>Sincerely,<br />The Tidepool Team</p></td></tr>` +
+		`<tr><td><a href="https://app.tidepool.org/{{ .Key }}">Accept invite</a><a href="https://tidepool.org"><img src="logo.png" /></a></td></tr></table>` +
+		`</body></html>`
+	expectedText := "Hello Test User,\n\nSincerely,\nThe Tidepool Team\n\nAccept invite (https://app.tidepool.org/123.blah.456.blah)"
+	tmpl, _ := templates.NewPrecompiledTemplate(name, subjectSuccessTemplate, htmlBody)
+	result, err := tmpl.Execute(content)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if result.TextBody != expectedText {
+		t.Fatalf(`Text body is "%s", but should be "%s"`, result.TextBody, expectedText)
+	}
+}
+
+func Test_NewPrecompiledTemplateWithText_ExecuteSuccess(t *testing.T) {
+	expectedText := `Key is 123.blah.456.blah & <unescaped>`
+	tmpl, err := templates.NewPrecompiledTemplateWithText(name, subjectSuccessTemplate, bodySuccessTemplate, `Key is {{ .Key }} & <unescaped>`)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	result, err := tmpl.Execute(content)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+	if result.TextBody != expectedText {
+		t.Fatalf(`Text body is "%s", but should be "%s"`, result.TextBody, expectedText)
+	}
+}
+
+func Test_NewPrecompiledTemplate_Variables(t *testing.T) {
+	body := `{{ if .FullName }}Hi {{ .FullName }}{{ else }}Hi{{ end }}, {{ range .Items }}{{ .Ignored }}{{ end }}{{ $.Key }}`
+	tmpl, err := templates.NewPrecompiledTemplate(name, subjectSuccessTemplate, body)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	schema := tmpl.Variables()
+	if strings.Join(schema.Required, ",") != "Key,Username" {
+		t.Fatalf(`Required variables are %v, but should be [Key Username]`, schema.Required)
+	}
+	if strings.Join(schema.Optional, ",") != "FullName,Items" {
+		t.Fatalf(`Optional variables are %v, but should be [FullName Items]`, schema.Optional)
+	}
+	if missing := schema.Missing(map[string]string{"Username": ""}); strings.Join(missing, ",") != "Key" {
+		t.Fatalf(`Missing variables are %v, but should be [Key]`, missing)
+	}
+}
+
+func Test_NewPrecompiledTemplate_Variables_NestedScopes(t *testing.T) {
+	body := `{{ define "greeting" }}Hi {{ .FullName }}{{ end }}` +
+		`{{ define "item" }}{{ .Name }} {{ $.Ignored }}{{ end }}` +
+		`{{ template "greeting" . }}, ` +
+		`{{ range .Items }}{{ .Ignored }} {{ $.Currency }} {{ template "item" . }}{{ end }}` +
+		`{{ with .Account }}{{ .Ignored }} {{ $.Key }}{{ end }}`
+	tmpl, err := templates.NewPrecompiledTemplate(name, subjectSuccessTemplate, body)
+	if err != nil {
+		t.Fatalf(`Error is "%s", but should be nil`, err)
+	}
+
+	schema := tmpl.Variables()
+	if strings.Join(schema.Required, ",") != "FullName,Username" {
+		t.Fatalf(`Required variables are %v, but should be [FullName Username]`, schema.Required)
+	}
+	if strings.Join(schema.Optional, ",") != "Account,Currency,Items,Key" {
+		t.Fatalf(`Optional variables are %v, but should be [Account Currency Items Key]`, schema.Optional)
+	}
+}
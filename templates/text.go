@@ -0,0 +1,121 @@
+package templates
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlToText converts a rendered html email to a plain text alternative. It keeps the
+// paragraph structure of the document and appends the target of each link after its text.
+func htmlToText(document string) (string, error) {
+	root, err := html.Parse(strings.NewReader(document))
+	if err != nil {
+		return "", err
+	}
+
+	w := &textWriter{}
+	w.node(root)
+	return strings.TrimSpace(w.b.String()), nil
+}
+
+type textWriter struct {
+	b            strings.Builder
+	newlines     int
+	pendingSpace bool
+}
+
+func (w *textWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+		switch n.DataAtom {
+		case atom.Head, atom.Style, atom.Script, atom.Title, atom.Img:
+			return
+		case atom.Br:
+			w.b.WriteString("\n")
+			w.newlines++
+			w.pendingSpace = false
+			return
+		case atom.A:
+			w.link(n)
+			return
+		case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Table, atom.Ul, atom.Ol, atom.Blockquote, atom.Hr:
+			w.block(2)
+			w.children(n)
+			w.block(2)
+			return
+		case atom.Div, atom.Center, atom.Tr, atom.Td, atom.Th, atom.Section, atom.Header, atom.Footer:
+			w.block(1)
+			w.children(n)
+			w.block(1)
+			return
+		case atom.Li:
+			w.block(1)
+			w.text("- ")
+			w.children(n)
+			w.block(1)
+			return
+		}
+	}
+
+	w.children(n)
+}
+
+func (w *textWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+func (w *textWriter) link(n *html.Node) {
+	start := w.b.Len()
+	w.children(n)
+	text := strings.TrimSpace(w.b.String()[start:])
+	if text == "" {
+		return
+	}
+
+	href := ""
+	for _, attr := range n.Attr {
+		if attr.Key == "href" {
+			href = strings.TrimSpace(attr.Val)
+		}
+	}
+	if href == "" || href == text || strings.HasPrefix(href, "#") || strings.HasPrefix(href, "mailto:") {
+		return
+	}
+
+	w.text(" (" + href + ")")
+}
+
+// text writes the inline content collapsing consecutive whitespace
+func (w *textWriter) text(s string) {
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			w.pendingSpace = w.b.Len() > 0 && w.newlines == 0
+			continue
+		}
+		if w.pendingSpace {
+			w.b.WriteRune(' ')
+			w.pendingSpace = false
+		}
+		w.b.WriteRune(r)
+		w.newlines = 0
+	}
+}
+
+// block makes sure the output ends with at least n line breaks
+func (w *textWriter) block(n int) {
+	w.pendingSpace = false
+	if w.b.Len() == 0 {
+		return
+	}
+	for ; w.newlines < n; w.newlines++ {
+		w.b.WriteString("\n")
+	}
+}
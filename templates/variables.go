@@ -13,3 +13,13 @@ func NewGlobalVariables() (*GlobalVariables, error) {
 	vars := &GlobalVariables{}
 	return vars, envconfig.Process("", vars)
 }
+
+// Merge adds the global variables to the template variables, overriding any existing values
+func (g GlobalVariables) Merge(vars map[string]string) map[string]string {
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	vars["AssetURL"] = g.AssetUrl
+	vars["WebURL"] = g.WebAppUrl
+	return vars
+}